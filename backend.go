@@ -0,0 +1,192 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errInvocationFileSSH = errors.New("gosh: FuncCmd invocation is too large to pass to an SSH backend")
+
+// ExecBackend determines how a Shell launches its commands, e.g. on a remote
+// host. It maps a description of a command to a description of the local
+// command that runs it. The local command's stdin, stdout, and stderr are
+// connected to the command's, so output capture works as usual, as does
+// AwaitVars if the launched binary speaks the gosh control protocol.
+//
+// Note that signals (e.g. from Cmd.Signal or Cmd.Terminate) are delivered to
+// the local command, not necessarily to the command it runs.
+type ExecBackend interface {
+	// Command returns the local command that runs the described command.
+	//
+	// In d, Path and Args[0] are the name passed to Shell.Cmd, not resolved
+	// locally; Dir is the working directory set via Cmd.Adopt, or empty; and Env
+	// holds only the vars set by gosh, i.e. the vars added to or changed in
+	// Shell.Vars and Cmd.Vars since NewShell, and gosh control vars, not the env
+	// of the current process.
+	//
+	// In the result, Path is resolved using the local PATH if it contains no path
+	// separators; Dir is the local working directory, where empty means the
+	// current one; and Env, if nil, means the env of the current process.
+	Command(d CmdDescription) (CmdDescription, error)
+}
+
+// SSHConfig configures the ExecBackend returned by NewSSHBackend.
+type SSHConfig struct {
+	// Binary is the ssh client to run. If empty, "ssh" is used.
+	Binary string
+	// User is the remote user. If empty, the ssh client's default is used.
+	User string
+	// Port is the remote port. If zero, the ssh client's default is used.
+	Port int
+	// IdentityFile, if non-empty, is the private key file to authenticate with.
+	IdentityFile string
+	// Options are extra arguments for the ssh client, placed before the host,
+	// e.g. []string{"-o", "StrictHostKeyChecking=no"}.
+	Options []string
+}
+
+// NewSSHBackend returns an ExecBackend that runs commands on the given host,
+// using the ssh command-line client. Command names are resolved using the
+// remote PATH. Commands created by FuncCmd run the current executable, so it
+// must exist at the same path on the remote host.
+//
+// Authentication must not require interaction, e.g. it should use keys or an
+// ssh agent. The ssh client is run with -T, so that the command's stdout and
+// stderr are kept separate. Without a pty, sshd does not signal the remote
+// command when the connection goes away, so the command runs under a watchdog
+// that kills its process group with SIGTERM within about a second of the
+// session ending, e.g. because Cmd.Signal or Shell.Cleanup killed the local ssh
+// client. The command is put in its own process group via setsid(1), if the
+// remote host has it; otherwise, only the command itself is killed. The exit
+// code of a remote command terminated by a signal is 128 plus the signal
+// number.
+//
+// FuncCmd invocations whose encoded args are too large to pass via an env var
+// (over 32KB) are passed via a local file, which the remote host cannot read;
+// starting such commands fails.
+func NewSSHBackend(host string, config SSHConfig) ExecBackend {
+	return &sshBackend{host: host, config: config}
+}
+
+// DockerConfig configures the ExecBackend returned by NewDockerBackend.
+type DockerConfig struct {
+	// Binary is the docker client to run. If empty, "docker" is used.
+	Binary string
+	// User is the user (name or uid, optionally followed by ":group") to run as
+	// in the container. If empty, the container's default is used.
+	User string
+	// Options are extra arguments for "docker exec", placed before the container,
+	// e.g. []string{"--privileged"}.
+	Options []string
+}
+
+// NewDockerBackend returns an ExecBackend that runs commands in the given
+// running container, using "docker exec". Command names are resolved using the
+// container's PATH, and Cmd.Vars are passed via -e. Commands created by FuncCmd
+// run the current executable, so it must exist at the same path in the
+// container, e.g. via a bind mount.
+//
+// Paths passed to commands refer to the container's filesystem, whereas Shell
+// file operations (e.g. MakeTempDir) and output files (e.g. per
+// Shell.ChildOutputDir) use the local filesystem; share them with the container
+// via bind mounts if needed. Note that the docker client does not forward
+// signals to commands started via "docker exec".
+func NewDockerBackend(container string, config DockerConfig) ExecBackend {
+	return &dockerBackend{container: container, config: config}
+}
+
+////////////////////////////////////////
+// Internals
+
+type sshBackend struct {
+	host   string
+	config SSHConfig
+}
+
+func (b *sshBackend) Command(d CmdDescription) (CmdDescription, error) {
+	binary := b.config.Binary
+	if binary == "" {
+		binary = "ssh"
+	}
+	args := []string{binary, "-T"}
+	if b.config.User != "" {
+		args = append(args, "-l", b.config.User)
+	}
+	if b.config.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(b.config.Port))
+	}
+	if b.config.IdentityFile != "" {
+		args = append(args, "-i", b.config.IdentityFile)
+	}
+	if _, ok := d.Env[envInvocationFile]; ok {
+		return CmdDescription{}, errInvocationFileSSH
+	}
+	args = append(args, b.config.Options...)
+	d.Args = append([]string{"sh", "-c", sshWatchdog, "sh"}, d.Args...)
+	args = append(args, "--", b.host, remoteCommandLine(d))
+	return CmdDescription{Path: binary, Args: args}, nil
+}
+
+// sshWatchdog is a Bourne shell script that runs its args as a command, with
+// the script's stdin, and kills the command's process group (or just the
+// command, if setsid is not available) once the script's parent, i.e. the sshd
+// session process, exits. Commands started in the background get /dev/null as
+// stdin, hence the use of fd 3.
+const sshWatchdog = `exec 3<&0; ` +
+	`if command -v setsid >/dev/null 2>&1; then setsid "$@" <&3 3<&- & else "$@" <&3 3<&- & fi; ` +
+	`exec 3<&-; pid=$!; ` +
+	`(while kill -0 $PPID 2>/dev/null; do sleep 1; done; kill -TERM -$pid 2>/dev/null || kill -TERM $pid) </dev/null >/dev/null 2>&1 & ` +
+	`watcher=$!; wait $pid; status=$?; kill $watcher 2>/dev/null; exit $status`
+
+type dockerBackend struct {
+	container string
+	config    DockerConfig
+}
+
+func (b *dockerBackend) Command(d CmdDescription) (CmdDescription, error) {
+	binary := b.config.Binary
+	if binary == "" {
+		binary = "docker"
+	}
+	// Always pass -i, so that the command's stdin is connected if set.
+	args := []string{binary, "exec", "-i"}
+	if b.config.User != "" {
+		args = append(args, "-u", b.config.User)
+	}
+	if d.Dir != "" {
+		args = append(args, "-w", d.Dir)
+	}
+	for _, kv := range mapToSlice(d.Env) {
+		args = append(args, "-e", kv)
+	}
+	args = append(args, b.config.Options...)
+	args = append(args, b.container)
+	args = append(args, d.Args...)
+	return CmdDescription{Path: binary, Args: args}, nil
+}
+
+// remoteCommandLine returns a Bourne shell command line that runs the described
+// command, for backends whose remote side runs commands through a shell.
+func remoteCommandLine(d CmdDescription) string {
+	var parts []string
+	if d.Dir != "" {
+		parts = append(parts, "cd", shellQuote(d.Dir), "&&")
+	}
+	parts = append(parts, "exec")
+	if len(d.Env) > 0 {
+		parts = append(parts, "env")
+		for _, kv := range mapToSlice(d.Env) {
+			k, v := splitKeyValue(kv)
+			parts = append(parts, joinKeyValue(k, shellQuote(v)))
+		}
+	}
+	for _, arg := range d.Args {
+		parts = append(parts, shellQuote(arg))
+	}
+	return strings.Join(parts, " ")
+}
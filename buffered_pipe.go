@@ -5,14 +5,17 @@
 package gosh
 
 import (
-	"bytes"
 	"io"
 	"sync"
 )
 
+// chunkSize is the minimum capacity of each chunk in a bufferedPipe, and the
+// size of the buffer that ReadFrom reads into.
+const chunkSize = 1 << 15
+
 type bufferedPipe struct {
 	cond   *sync.Cond
-	buf    bytes.Buffer
+	chunks [][]byte // buffered data, in order; never contains empty chunks
 	closed bool
 }
 
@@ -25,6 +28,9 @@ var (
 // newBufferedPipe returns a new thread-safe pipe backed by an unbounded
 // in-memory buffer. Writes on the pipe never block; reads on the pipe block
 // until data is available.
+//
+// The buffer is a list of chunks, so that WriteTo can hand off whole chunks
+// without copying, and without holding the lock during I/O.
 func newBufferedPipe() io.ReadWriteCloser {
 	return &bufferedPipe{cond: sync.NewCond(&sync.Mutex{})}
 }
@@ -35,8 +41,15 @@ func (p *bufferedPipe) Read(d []byte) (int, error) {
 	defer p.cond.L.Unlock()
 	for {
 		// Read any remaining data before checking whether the pipe is closed.
-		if p.buf.Len() > 0 {
-			return p.buf.Read(d)
+		if len(p.chunks) > 0 {
+			n := copy(d, p.chunks[0])
+			if n == len(p.chunks[0]) {
+				p.chunks[0] = nil
+				p.chunks = p.chunks[1:]
+			} else {
+				p.chunks[0] = p.chunks[0][n:]
+			}
+			return n, nil
 		}
 		if p.closed {
 			return 0, io.EOF
@@ -49,19 +62,29 @@ func (p *bufferedPipe) Read(d []byte) (int, error) {
 // used by io.Copy.
 // Unlike Read, which returns io.EOF to signal that all data has been read,
 // WriteTo blocks until all data has been written to w, and never returns
-// io.EOF.
+// io.EOF. The lock is not held while writing to w, so writes to the pipe never
+// wait for w.
 func (p *bufferedPipe) WriteTo(w io.Writer) (int64, error) {
-	p.cond.L.Lock()
-	defer p.cond.L.Unlock()
 	var written int64
 	for {
-		// Keep writing data until the pipe is closed.
-		n, err := p.buf.WriteTo(w)
-		written += n
-		if p.closed || err != nil {
-			return written, err
+		p.cond.L.Lock()
+		for len(p.chunks) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		chunks := p.chunks
+		p.chunks = nil
+		p.cond.L.Unlock()
+		if len(chunks) == 0 {
+			// The pipe is closed, and all data has been written.
+			return written, nil
+		}
+		for _, chunk := range chunks {
+			n, err := w.Write(chunk)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
 		}
-		p.cond.Wait()
 	}
 }
 
@@ -72,20 +95,51 @@ func (p *bufferedPipe) Write(d []byte) (int, error) {
 	if p.closed {
 		return 0, io.ErrClosedPipe
 	}
+	if len(d) == 0 {
+		return 0, nil
+	}
 	defer p.cond.Signal()
-	return p.buf.Write(d)
+	// Append to the last chunk if it has room; otherwise, start a new chunk.
+	if n := len(p.chunks); n > 0 && cap(p.chunks[n-1])-len(p.chunks[n-1]) >= len(d) {
+		p.chunks[n-1] = append(p.chunks[n-1], d...)
+		return len(d), nil
+	}
+	size := chunkSize
+	if len(d) > size {
+		size = len(d)
+	}
+	p.chunks = append(p.chunks, append(make([]byte, 0, size), d...))
+	return len(d), nil
 }
 
 // ReadFrom implements the io.ReaderFrom method; it is the fast version of Write
-// used by io.Copy.
+// used by io.Copy. The lock is not held while reading from r, so that readers
+// of the pipe can consume data as it arrives. Data is read into a single reused
+// buffer and then written to the pipe, so that short reads from r don't each
+// pin a whole chunk.
 func (p *bufferedPipe) ReadFrom(r io.Reader) (int64, error) {
-	p.cond.L.Lock()
-	defer p.cond.L.Unlock()
-	if p.closed {
-		return 0, io.ErrClosedPipe
+	var read int64
+	buf := make([]byte, chunkSize)
+	for {
+		// Don't consume data from r that can't be written.
+		p.cond.L.Lock()
+		closed := p.closed
+		p.cond.L.Unlock()
+		if closed {
+			return read, io.ErrClosedPipe
+		}
+		n, err := r.Read(buf)
+		if _, err := p.Write(buf[:n]); err != nil {
+			return read, err
+		}
+		read += int64(n)
+		switch {
+		case err == io.EOF:
+			return read, nil
+		case err != nil:
+			return read, err
+		}
 	}
-	defer p.cond.Signal()
-	return p.buf.ReadFrom(r)
 }
 
 // Close closes the pipe.
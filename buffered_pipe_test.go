@@ -6,9 +6,12 @@ package gosh
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -35,6 +38,37 @@ func TestBufferedPipeReadWriteAfterClose(t *testing.T) {
 	if got, want := err, io.ErrClosedPipe; got != want {
 		t.Errorf("write after close got error %v, want %v", got, want)
 	}
+	// ReadFrom after close fails, without reading anything.
+	r := strings.NewReader("foo")
+	if n, err := p.(io.ReaderFrom).ReadFrom(r); n != 0 || err != io.ErrClosedPipe {
+		t.Errorf("ReadFrom after close got (%v, %v), want (0, %v)", n, err, io.ErrClosedPipe)
+	}
+	if got, want := r.Len(), 3; got != want {
+		t.Errorf("ReadFrom after close left %v bytes unread, want %v", got, want)
+	}
+}
+
+func TestIsClosedPipeError(t *testing.T) {
+	epipe := &os.PathError{Op: "write", Path: "|1", Err: syscall.EPIPE}
+	for _, err := range []error{
+		io.ErrClosedPipe,
+		fmt.Errorf("wrapped: %w", io.ErrClosedPipe),
+		epipe,
+		fmt.Errorf("wrapped: %w", epipe),
+	} {
+		if !isClosedPipeError(err) {
+			t.Errorf("isClosedPipeError(%v) got false, want true", err)
+		}
+	}
+	for _, err := range []error{
+		nil,
+		io.EOF,
+		&os.PathError{Op: "read", Path: "|0", Err: syscall.EPIPE},
+	} {
+		if isClosedPipeError(err) {
+			t.Errorf("isClosedPipeError(%v) got true, want false", err)
+		}
+	}
 }
 
 func TestBufferedPipeReadFromWriteTo(t *testing.T) {
@@ -62,6 +96,22 @@ func TestBufferedPipeReadFromWriteTo(t *testing.T) {
 	}
 }
 
+// Tests that short reads by ReadFrom are packed into shared chunks, rather than
+// each pinning a chunk of its own.
+func TestBufferedPipeReadFromShortReads(t *testing.T) {
+	p := newBufferedPipe().(*bufferedPipe)
+	r := io.MultiReader(strings.NewReader("foo"), strings.NewReader("bar"), strings.NewReader("baz"))
+	if n, err := p.ReadFrom(r); n != 9 || err != nil {
+		t.Errorf("ReadFrom got (%v, %v), want (9, <nil>)", n, err)
+	}
+	if got, want := len(p.chunks), 1; got != want {
+		t.Errorf("got %v chunks, want %v", got, want)
+	}
+	if got, want := string(p.chunks[0]), "foobarbaz"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
 func TestBufferedPipeWriteToMany(t *testing.T) {
 	p := newBufferedPipe()
 	pR, pW := io.Pipe()
@@ -98,3 +148,34 @@ func TestBufferedPipeWriteToMany(t *testing.T) {
 		t.Errorf("WriteTo got (%v, %v), want (%v, <nil>)", n, err, nTotal)
 	}
 }
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// BenchmarkBufferedPipeCopy copies 100MB through a buffered pipe, using
+// ReadFrom on the write side and WriteTo on the read side.
+func BenchmarkBufferedPipeCopy(b *testing.B) {
+	const size = 100 << 20
+	b.SetBytes(size)
+	for i := 0; i < b.N; i++ {
+		p := newBufferedPipe()
+		done := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(ioutil.Discard, p)
+			done <- err
+		}()
+		if _, err := io.Copy(p, io.LimitReader(zeroReader{}, size)); err != nil {
+			b.Fatal(err)
+		}
+		p.Close()
+		if err := <-done; err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"io"
+	"sync"
+)
+
+// capture buffers a single output stream of a command, e.g. its stdout, so
+// that the stream is written once no matter how many times it is consumed.
+// Pipes returned by newReader each see the full stream, and String returns
+// everything written if keepAll was set.
+//
+// Unless keepAll is set, chunks that have been consumed by every reader are
+// dropped, so that streaming readers don't cause the entire stream to be held
+// in memory.
+type capture struct {
+	cond    *sync.Cond
+	chunks  [][]byte // buffered data, in order; never contains empty chunks
+	dropped int      // number of chunks dropped from the front of chunks
+	readers []*captureReader
+	keepAll bool // if true, chunks are never dropped
+	closed  bool // if true, no more data will be written
+	broken  bool // if true, a reader was closed, and writes fail
+}
+
+func newCapture() *capture {
+	return &capture{cond: sync.NewCond(&sync.Mutex{})}
+}
+
+// Write appends to the buffer. It fails with io.ErrClosedPipe if any reader has
+// been closed, mirroring the behavior of writing to a closed pipe.
+func (c *capture) Write(d []byte) (int, error) {
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	if c.closed || c.broken {
+		return 0, io.ErrClosedPipe
+	}
+	if len(d) == 0 {
+		return 0, nil
+	}
+	defer c.cond.Broadcast()
+	// Append to the last chunk if it has room; otherwise, start a new chunk.
+	// Readers only ever look at the chunk length that was current at the time of
+	// the read, so appending in place is safe.
+	if n := len(c.chunks); n > 0 && cap(c.chunks[n-1])-len(c.chunks[n-1]) >= len(d) {
+		c.chunks[n-1] = append(c.chunks[n-1], d...)
+		return len(d), nil
+	}
+	size := chunkSize
+	if len(d) > size {
+		size = len(d)
+	}
+	c.chunks = append(c.chunks, append(make([]byte, 0, size), d...))
+	return len(d), nil
+}
+
+// Close signals that no more data will be written. Readers return io.EOF once
+// they have consumed all data.
+func (c *capture) Close() error {
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	if !c.closed {
+		defer c.cond.Broadcast()
+		c.closed = true
+	}
+	return nil
+}
+
+// String returns all data written so far. Must only be used if keepAll was set
+// before any data was written.
+func (c *capture) String() string {
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	n := 0
+	for _, chunk := range c.chunks {
+		n += len(chunk)
+	}
+	res := make([]byte, 0, n)
+	for _, chunk := range c.chunks {
+		res = append(res, chunk...)
+	}
+	return string(res)
+}
+
+// newReader returns a new pipe that reads the stream from the beginning. Must
+// be called before any data is written.
+func (c *capture) newReader() io.ReadCloser {
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	r := &captureReader{c: c}
+	c.readers = append(c.readers, r)
+	return r
+}
+
+// dropConsumed drops chunks that have been fully consumed by all readers. Must
+// be called with the lock held.
+func (c *capture) dropConsumed() {
+	if c.keepAll {
+		return
+	}
+	min := c.dropped + len(c.chunks)
+	for _, r := range c.readers {
+		if r.chunk < min {
+			min = r.chunk
+		}
+	}
+	for c.dropped < min {
+		c.chunks[0] = nil
+		c.chunks = c.chunks[1:]
+		c.dropped++
+	}
+}
+
+// captureReader reads a capture from the beginning.
+type captureReader struct {
+	c      *capture
+	chunk  int  // absolute index of the current chunk; protected by c.cond.L
+	offset int  // offset within the current chunk; protected by c.cond.L
+	closed bool // protected by c.cond.L
+}
+
+var _ io.WriterTo = (*captureReader)(nil)
+
+// next waits until data is available, then returns the available data of the
+// current chunk, or nil if all data has been read. Must be called with the lock
+// held.
+func (r *captureReader) next() []byte {
+	c := r.c
+	for {
+		if i := r.chunk - c.dropped; i < len(c.chunks) {
+			if d := c.chunks[i][r.offset:]; len(d) > 0 {
+				return d
+			}
+			// The current chunk has been fully read; only move on once a later
+			// chunk exists, since more data may be appended to the current chunk.
+			if i+1 < len(c.chunks) {
+				r.chunk, r.offset = r.chunk+1, 0
+				c.dropConsumed()
+				continue
+			}
+		}
+		if c.closed || c.broken || r.closed {
+			return nil
+		}
+		c.cond.Wait()
+	}
+}
+
+// Read reads from the pipe.
+func (r *captureReader) Read(d []byte) (int, error) {
+	r.c.cond.L.Lock()
+	defer r.c.cond.L.Unlock()
+	data := r.next()
+	if data == nil {
+		return 0, io.EOF
+	}
+	n := copy(d, data)
+	r.offset += n
+	return n, nil
+}
+
+// WriteTo implements the io.WriterTo method; it is the fast version of Read
+// used by io.Copy. The lock is not held while writing to w.
+func (r *captureReader) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for {
+		r.c.cond.L.Lock()
+		data := r.next()
+		r.offset += len(data)
+		r.c.cond.L.Unlock()
+		if data == nil {
+			return written, nil
+		}
+		n, err := w.Write(data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// Close closes the pipe. Subsequent writes to the capture fail with
+// io.ErrClosedPipe.
+func (r *captureReader) Close() error {
+	r.c.cond.L.Lock()
+	defer r.c.cond.L.Unlock()
+	if !r.closed {
+		defer r.c.cond.Broadcast()
+		r.closed = true
+		r.c.broken = true
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCaptureMultipleReaders(t *testing.T) {
+	c := newCapture()
+	r1, r2 := c.newReader(), c.newReader()
+	for _, s := range []string{"foo", "bar", strings.Repeat("x", chunkSize)} {
+		if n, err := c.Write([]byte(s)); n != len(s) || err != nil {
+			t.Errorf("write got (%v, %v), want (%v, <nil>)", n, err, len(s))
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("close failed: %v", err)
+	}
+	want := "foobar" + strings.Repeat("x", chunkSize)
+	// Each reader sees the full stream, via both Read and WriteTo.
+	if b, err := ioutil.ReadAll(r1); string(b) != want || err != nil {
+		t.Errorf("read got (%d bytes, %v), want (%d bytes, <nil>)", len(b), err, len(want))
+	}
+	var buf bytes.Buffer
+	if n, err := io.Copy(&buf, r2); n != int64(len(want)) || buf.String() != want || err != nil {
+		t.Errorf("copy got (%v, %v), want (%v, <nil>)", n, err, len(want))
+	}
+	// All chunks were consumed by all readers, so they have been dropped.
+	if got := len(c.chunks); got != 1 {
+		t.Errorf("got %v chunks, want 1", got)
+	}
+}
+
+func TestCaptureKeepAll(t *testing.T) {
+	c := newCapture()
+	c.keepAll = true
+	r := c.newReader()
+	c.Write([]byte(strings.Repeat("x", chunkSize)))
+	c.Write([]byte("foo"))
+	c.Close()
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.String(), strings.Repeat("x", chunkSize)+"foo"; got != want {
+		t.Errorf("got %d bytes, want %d bytes", len(got), len(want))
+	}
+}
+
+func TestCaptureReaderClose(t *testing.T) {
+	c := newCapture()
+	r1, r2 := c.newReader(), c.newReader()
+	c.Write([]byte("foo"))
+	if err := r1.Close(); err != nil {
+		t.Errorf("close failed: %v", err)
+	}
+	// Write after a reader is closed fails.
+	if n, err := c.Write([]byte("bar")); n != 0 || err != io.ErrClosedPipe {
+		t.Errorf("write after close got (%v, %v), want (0, %v)", n, err, io.ErrClosedPipe)
+	}
+	// Other readers see the data written before the close, terminated by EOF.
+	if b, err := ioutil.ReadAll(r2); string(b) != "foo" || err != nil {
+		t.Errorf("read got (%s, %v), want (foo, <nil>)", b, err)
+	}
+}
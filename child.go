@@ -7,26 +7,130 @@ package gosh
 // This file contains functions meant to be called from a child process.
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-var (
-	varsPrefix = []byte("<goshVars")
-	varsSuffix = []byte("goshVars>")
-)
+// defaultVarsTag is the tag used to delimit vars sent by SendVars when
+// Shell.VarsTag is empty.
+const defaultVarsTag = "goshVars"
+
+// varsMarkers returns the prefix and suffix that delimit vars sent by SendVars,
+// given the tag, e.g. "<goshVars" and "goshVars>".
+func varsMarkers(tag string) ([]byte, []byte) {
+	if tag == "" {
+		tag = defaultVarsTag
+	}
+	return []byte("<" + tag), []byte(tag + ">")
+}
 
 // SendVars sends the given vars to the parent process. Writes a string of the
-// form "<goshVars{ ... JSON-encoded vars ... }goshVars>\n" to stderr.
-func SendVars(vars map[string]string) {
+// form "<goshVars{ ... JSON-encoded vars ... }goshVars>\n" to stderr, where
+// "goshVars" is replaced by Shell.VarsTag if set in the parent. Returns an
+// error if the vars could not be encoded or written, e.g. because stderr was
+// closed; callers that don't care can ignore it.
+func SendVars(vars map[string]string) error {
+	return sendVars(os.Stderr, vars)
+}
+
+// addrVar is the var via which AnnounceAddr sends a listener's address.
+const addrVar = "goshAddr"
+
+// AnnounceAddr sends the address of the given listener to the parent process,
+// which can retrieve it using Cmd.AwaitAddr. It codifies the common pattern of
+// listening on port 0, then sending the chosen address via SendVars. Since the
+// listener queues incoming connections as soon as it is created, the parent may
+// connect immediately, even if the child has not yet started serving.
+func AnnounceAddr(ln net.Listener) error {
+	return SendVars(map[string]string{addrVar: ln.Addr().String()})
+}
+
+// AnnounceListeners is like AnnounceAddr, but for servers with multiple
+// listeners, e.g. "http" and "debug". It sends the address of each listener,
+// keyed by name, to the parent process, which can retrieve them using
+// Cmd.AwaitAddrs.
+func AnnounceListeners(lns map[string]net.Listener) error {
+	vars := make(map[string]string, len(lns))
+	for name, ln := range lns {
+		vars[addrVarForName(name)] = ln.Addr().String()
+	}
+	return SendVars(vars)
+}
+
+// addrVarForName returns the var via which AnnounceListeners sends the address
+// of the named listener.
+func addrVarForName(name string) string {
+	return addrVar + "." + name
+}
+
+// sendVarsMu serializes writes by sendVars, so that concurrent messages are
+// never interleaved.
+var sendVarsMu sync.Mutex
+
+// sendVars writes the given vars to w, in the format read by recvWriter. The
+// message is written with a single call to w.Write, so that it isn't
+// interleaved with other output.
+func sendVars(w io.Writer, vars map[string]string) error {
 	data, err := json.Marshal(vars)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	prefix, suffix := varsMarkers(os.Getenv(envVarsTag))
+	msg := make([]byte, 0, len(prefix)+len(data)+len(suffix)+1)
+	msg = append(append(append(append(msg, prefix...), data...), suffix...), '\n')
+	sendVarsMu.Lock()
+	defer sendVarsMu.Unlock()
+	_, err = w.Write(msg)
+	return err
+}
+
+// childCtxGracePeriod is how long a child gives a function that was passed
+// childCtx to return after childCtx is canceled, before the child exits.
+const childCtxGracePeriod = time.Second
+
+var (
+	// childCtx is passed to registered functions that take a leading
+	// context.Context.
+	childCtx, cancelChildCtx = context.WithCancel(context.Background())
+	childCtxOnce             sync.Once
+	usedChildCtx             int32 // accessed atomically
+)
+
+// childContext returns childCtx, and arranges for it to be canceled when the
+// current process receives SIGINT or SIGTERM. If the function doesn't return
+// within the grace period, the process is then killed by the signal, as if it
+// had not been caught.
+func childContext() context.Context {
+	childCtxOnce.Do(func() {
+		atomic.StoreInt32(&usedChildCtx, 1)
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := (<-ch).(syscall.Signal)
+			cancelChildContext()
+			signal.Reset(sig)
+			syscall.Kill(os.Getpid(), sig)
+		}()
+	})
+	return childCtx
+}
+
+// cancelChildContext cancels childCtx and, if it was passed to a function,
+// gives that function a grace period to return.
+func cancelChildContext() {
+	cancelChildCtx()
+	if atomic.LoadInt32(&usedChildCtx) != 0 {
+		time.Sleep(childCtxGracePeriod)
 	}
-	fmt.Fprintf(os.Stderr, "%s%s%s\n", varsPrefix, data, varsSuffix)
 }
 
 // watchParent periodically checks whether the parent process has exited and, if
@@ -34,6 +138,7 @@ func SendVars(vars map[string]string) {
 func watchParent() {
 	for {
 		if os.Getppid() == 1 {
+			cancelChildContext()
 			log.Fatal("gosh: parent process has exited")
 		}
 		time.Sleep(time.Second)
@@ -44,6 +149,7 @@ func watchParent() {
 // Meant to be run in a goroutine.
 func exitAfter(d time.Duration) {
 	time.Sleep(d)
+	cancelChildContext()
 	log.Fatalf("gosh: timed out after %v", d)
 }
 
@@ -0,0 +1,31 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import "time"
+
+// Clock is the source of time used by a Shell and its Cmds, e.g. for
+// timeouts, grace periods, and timestamps. Tests may replace Shell.Clock to
+// control timing deterministically.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// realClock is a Clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+// clock returns sh.Clock, or the real clock if sh.Clock is nil.
+func (sh *Shell) clock() Clock {
+	if sh.Clock == nil {
+		return realClock{}
+	}
+	return sh.Clock
+}
@@ -5,38 +5,57 @@
 package gosh
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-
-	"v.io/x/lib/lookpath"
 )
 
 var (
 	errAlreadyCalledStart = errors.New("gosh: already called Cmd.Start")
 	errAlreadyCalledWait  = errors.New("gosh: already called Cmd.Wait")
 	errAlreadySetStdin    = errors.New("gosh: already set stdin")
-	errDidNotCallStart    = errors.New("gosh: did not call Cmd.Start")
-	errProcessExited      = errors.New("gosh: process exited")
+	errDetachedAwaitVars  = errors.New("gosh: cannot call AwaitVars on a detached Cmd")
+	errDetachedWithIO     = errors.New("gosh: detached Cmd cannot have stdin, stdout, or stderr pipes or writers")
+	errFileWithWriters    = errors.New("gosh: cannot set a file for a stream that has pipes or writers")
+	errMergeStderrWithIO  = errors.New("gosh: Cmd with MergeStderrIntoStdout cannot have stderr pipes, writers, or files")
+	errNoPty              = errors.New("gosh: Cmd has no pty")
+	errPtyAwaitVars       = errors.New("gosh: cannot call AwaitVars on a Cmd with a pty")
+	errPtyWithIO          = errors.New("gosh: Cmd with a pty cannot have stdin, stdout, or stderr pipes, writers, or files, or be detached")
+	errStderrFileVars     = errors.New("gosh: cannot call AwaitVars on a Cmd whose stderr is a file")
+	errInvalidNice        = errors.New("gosh: Cmd.Nice must be in the range [-20, 19]")
 )
 
 // Cmd represents a command. Not thread-safe.
 // Public fields should not be modified after calling Start.
 type Cmd struct {
-	// Err is the most recent error from this Cmd (may be nil).
+	// Err is the most recent error from this Cmd (may be nil). If the process
+	// exits with a non-zero exit code or is terminated by a signal, Err is an
+	// *ExitError that wraps the *exec.ExitError; use errors.As, since a direct
+	// type assertion to *exec.ExitError fails.
 	Err error
 	// Path is the path of the command to run.
 	Path string
-	// Vars is the map of env vars for this Cmd.
+	// Vars is the map of env vars for this Cmd, initialized from Shell.Vars. See
+	// Shell.Vars for how it determines the child's env.
 	Vars map[string]string
 	// Args is the list of args for this Cmd, starting with the resolved path.
 	// Note, we set Args[0] to the resolved path (rather than the user-specified
@@ -53,18 +72,104 @@ type Cmd struct {
 	ExitAfter time.Duration
 	// PropagateOutput is inherited from Shell.PropagateChildOutput.
 	PropagateOutput bool
-	// OutputDir is inherited from Shell.ChildOutputDir.
+	// TimestampOutput is inherited from Shell.TimestampChildOutput.
+	TimestampOutput bool
+	// LogOutput is inherited from Shell.LogChildOutput.
+	LogOutput bool
+	// OutputDir is inherited from Shell.ChildOutputDir, or from its per-run
+	// subdirectory if Shell.ChildOutputDirPerRun is set. It is created if needed.
 	OutputDir string
-	// ExitErrorIsOk specifies whether an *exec.ExitError should be reported via
-	// Shell.HandleError.
+	// CompressOutput is inherited from Shell.CompressChildOutput. It does not
+	// apply to detached commands, which write directly to their output files.
+	CompressOutput bool
+	// OutputHistory is the number of bytes of recent output retained from each
+	// of stdout and stderr, so that AwaitOutput sees lines written before it is
+	// called. If zero, 64KB is retained; if negative, none is. Up to twice this
+	// amount may be retained at a time, and none is retained once Wait returns.
+	OutputHistory int
+	// ExitErrorIsOk specifies whether an *ExitError, i.e. a non-zero exit code or
+	// termination by a signal, should be reported via Shell.HandleError.
 	ExitErrorIsOk bool
 	// IgnoreClosedPipeError, if true, causes errors from read/write on a closed
 	// pipe to be indistinguishable from success. These errors often occur in
 	// command pipelines, e.g. "yes | head -1", where "yes" will receive a closed
 	// pipe error when it tries to write on stdout, after "head" has exited. If a
 	// closed pipe error occurs, Cmd.Err will be nil, and no err is reported to
-	// Shell.HandleError.
+	// Shell.HandleError. This includes the case where the process exits with a
+	// non-zero exit code after its output could not be written to a closed pipe.
 	IgnoreClosedPipeError bool
+	// Wrapper, if non-empty, specifies a command (e.g. "strace -f") through which
+	// to run this Cmd, such that the child's argv becomes Wrapper followed by
+	// Args. Wrapper[0] is resolved using the child's PATH.
+	Wrapper []string
+	// Nice, if non-zero, specifies the nice value (scheduling priority) of the
+	// child process, in the range [-20, 19], where higher values mean lower
+	// priority. It is applied before the command runs, by running it via the
+	// nice command, so that it covers the child's entire lifetime and all of its
+	// threads. Start fails if nice is not found in the child's PATH; for commands
+	// run via Shell.Backend, nice must instead exist where the backend runs the
+	// command, and the command fails there if it does not. Positive values
+	// require no special privileges; negative values typically do, and without
+	// privilege nice typically warns and runs the command at its default
+	// priority. Like Limits, it is not applied (a warning is logged) for
+	// commands started by a Runner such as FakeRunner.
+	Nice int
+	// Limits specifies resource limits for the child process. They are applied
+	// before the command runs, by running it via /bin/sh's ulimit builtin, so
+	// that they cover the child's entire lifetime. If a limit cannot be set, the
+	// command does not run, and Wait fails with the shell's exit status.
+	Limits Limits
+	// Credential, if non-nil, specifies the user and group ids the child process
+	// runs as, e.g. to test privilege-dropping behavior. Setting credentials
+	// other than the parent's own typically requires the parent to run as root;
+	// Start fails with a descriptive error if the parent lacks privilege.
+	Credential *syscall.Credential
+	// SysProcAttr, if non-nil, holds platform-specific attributes for the child
+	// process, e.g. Chroot or Pdeathsig. At Start, gosh copies it and overrides
+	// the fields it manages: Setpgid, Pgid, Setsid, Setctty, and Ctty (for
+	// process group, session, and pty setup), and Credential if Cmd.Credential
+	// is set.
+	SysProcAttr *syscall.SysProcAttr
+	// ClearEnv, if true, makes it so the child process does not inherit the
+	// parent process's env; its env consists only of the vars added to or changed
+	// in Shell.Vars and Cmd.Vars since NewShell initialized Shell.Vars, plus gosh
+	// control vars.
+	ClearEnv bool
+	// InheritStdin, if true, makes the child process read stdin directly from
+	// the parent's stdin, e.g. so that an interactive child can prompt the user.
+	// It cannot be combined with StdinPipe or SetStdinReader; Start fails if it
+	// is.
+	InheritStdin bool
+	// MergeStderrIntoStdout, if true, makes the child's stderr the same file
+	// descriptor as its stdout, as with "2>&1" in a shell, so that the child sees
+	// a single stream and the interleaving of its output is byte-exact. All output
+	// is delivered to stdout pipes, writers, and files, and vars sent by the
+	// child are read from stdout. It cannot be combined with stderr pipes,
+	// writers (including TeeStderr), or files, and no stderr file is created in
+	// OutputDir. Unlike CombinedOutput, which merges the two streams in
+	// the parent as they are read, this merges them in the child.
+	MergeStderrIntoStdout bool
+	// Pty, if true, connects the child's stdin, stdout, and stderr to a newly
+	// allocated pseudo-terminal, for programs that behave differently when not
+	// run in a terminal. The child runs in a new session, with the pty as its
+	// controlling terminal. Use PtyFile to interact with the child. It cannot be
+	// combined with stdin, stdout, or stderr pipes, writers, or files, or with
+	// Detached, and AwaitVars is not supported. Currently only supported on
+	// Linux.
+	Pty bool
+	// Detached, if true, makes the child process a daemon that intentionally
+	// outlives this process: it runs in a new session, is not cleaned up by
+	// Shell.Cleanup, and does not exit when its parent exits (as with
+	// IgnoreParentExit). Because the parent may exit, a detached child cannot
+	// have stdin, stdout, or stderr pipes or writers, and its output is
+	// discarded unless OutputDir is set. AwaitVars is thus not supported.
+	Detached bool
+	// Context, if non-nil, bounds the lifetime of the child process. Start fails
+	// if it is already done, and once it is done, the child's process group is
+	// interrupted and then, after a grace period, killed, as in Shell.Cleanup;
+	// Wait then returns the context's error. Does not apply to detached
+	// commands. Inherited from Shell.Context.
+	Context context.Context
 	// ExtraFiles is used to populate ExtraFiles in the underlying exec.Cmd
 	// object. Does not get cloned.
 	ExtraFiles []*os.File
@@ -75,20 +180,69 @@ type Cmd struct {
 	calledWait        bool
 	cond              *sync.Cond
 	waitChan          chan error
+	waitOnce          sync.Once
+	waitErr           error // set by waitOnce
 	stdinDoneChan     chan error
-	started           bool // protected by sh.cleanupMu
-	exited            bool // protected by cond.L
-	calledCleanup     bool // protected by cleanupMu
+	started           bool          // protected by sh.cleanupMu
+	holdsRunSlot      bool          // counted toward Shell.MaxRunningCmds
+	internal          bool          // run by gosh itself, e.g. by BuildGoPkg
+	exactEnv          bool          // env is exactly Vars, per Shell.Adopt
+	skipped           bool          // skipped by Then or Else
+	skipErr           error         // outcome of the chain that skipped this Cmd
+	backend           ExecBackend   // per Shell.Backend; nil means local
+	runner            Runner        // per Shell.Runner; nil means os/exec
+	proc              Process       // protected by sh.cleanupMu
+	state             ProcessState  // protected by cond.L
+	exited            bool          // protected by cond.L
+	exitTime          time.Time     // protected by cond.L
+	canceled          bool          // stopped per Context; protected by cond.L
+	sentKill          bool          // gosh sent SIGKILL; protected by cond.L
+	exitedChan        chan struct{} // closed when the process exits
+	calledCleanup     bool          // protected by cleanupMu
 	cleanupMu         sync.Mutex
 	stdoutHeadTail    *headTail
 	stderrHeadTail    *headTail
+	stdoutTee         *teeWriter
+	stderrTee         *teeWriter
+	stdoutCapture     *capture // created on first use
+	stderrCapture     *capture // created on first use
 	stdoutWriters     []io.Writer
 	stderrWriters     []io.Writer
+	outputFiles       []string  // OutputDir files, renamed once the PID is known
+	outputStamp       string    // timestamp in the names of outputFiles
+	startTime         time.Time // set by start
+	ptyMaster         *os.File  // set by start if Pty is true
+	stdoutFile        *os.File  // set by SetStdoutFile
+	stderrFile        *os.File  // set by SetStderrFile
 	afterStartClosers []io.Closer
 	afterWaitClosers  []io.Closer
 	recvVars          map[string]string // protected by cond.L
+	linesErr          error             // protected by cond.L
+	sawClosedPipe     int32             // accessed atomically
+}
+
+// Limits specifies resource limits for a child process. Zero values mean no
+// limit.
+type Limits struct {
+	// MaxMemoryBytes limits the size of the process's virtual memory
+	// (RLIMIT_AS). It is rounded down to a multiple of 1024.
+	MaxMemoryBytes uint64
+	// MaxCPUSeconds limits the process's CPU time (RLIMIT_CPU). Upon reaching
+	// this limit, the process receives SIGXCPU, followed by SIGKILL one second
+	// later. If the process is killed by SIGXCPU, or by a SIGKILL not sent by
+	// gosh after reaching this limit, Cmd.Wait fails with ErrCPULimitExceeded.
+	MaxCPUSeconds uint64
 }
 
+// ErrCPULimitExceeded is the error reported when a process is killed for
+// exceeding Limits.MaxCPUSeconds.
+var ErrCPULimitExceeded = errors.New("gosh: process exceeded its CPU time limit")
+
+// ErrProcessExited is the error reported when an operation requires a running
+// process, but the process has already exited, e.g. by AwaitVars, and stored in
+// Cmd.Err by Signal.
+var ErrProcessExited = errors.New("gosh: process exited")
+
 // Shell returns the shell that this Cmd was created from.
 func (c *Cmd) Shell() *Shell {
 	return c.sh
@@ -102,6 +256,21 @@ func (c *Cmd) Clone() *Cmd {
 	return res
 }
 
+// Restart stops this command's process if it is running, then starts a fresh
+// process using a copy of this Cmd's configuration (see Clone), and returns the
+// new Cmd. The process is stopped as in Shell.Cleanup, i.e. its process group
+// is sent SIGINT, then SIGKILL after a grace period; its exit code is ignored.
+// The new Cmd has none of this Cmd's runtime state: vars received from the old
+// process are not visible to the new Cmd's AwaitVars, and stdin, stdout, and
+// stderr pipes and writers are not carried over. To configure those, use
+// Terminate, Clone, and Start instead.
+func (c *Cmd) Restart() *Cmd {
+	c.sh.Ok()
+	res, err := c.restart()
+	c.handleError(err)
+	return res
+}
+
 // StdinPipe returns a WriteCloser backed by an unlimited-size pipe for the
 // command's stdin. The pipe will be closed when the process exits, but may also
 // be closed earlier by the caller, e.g. if the command does not exit until its
@@ -118,7 +287,8 @@ func (c *Cmd) StdinPipe() io.WriteCloser {
 // command's stdout. The pipe will be closed when the process exits, but may
 // also be closed earlier by the caller, e.g. if all expected output has been
 // received. Must be called before Start. May be called more than once; each
-// call creates a new pipe.
+// call returns a new pipe that reads stdout from the beginning, but the output
+// is only buffered once.
 func (c *Cmd) StdoutPipe() io.ReadCloser {
 	c.sh.Ok()
 	res, err := c.stdoutPipe()
@@ -130,7 +300,8 @@ func (c *Cmd) StdoutPipe() io.ReadCloser {
 // command's stderr. The pipe will be closed when the process exits, but may
 // also be closed earlier by the caller, e.g. if all expected output has been
 // received. Must be called before Start. May be called more than once; each
-// call creates a new pipe.
+// call returns a new pipe that reads stderr from the beginning, but the output
+// is only buffered once.
 func (c *Cmd) StderrPipe() io.ReadCloser {
 	c.sh.Ok()
 	res, err := c.stderrPipe()
@@ -138,9 +309,44 @@ func (c *Cmd) StderrPipe() io.ReadCloser {
 	return res
 }
 
-// SetStdinReader configures this Cmd to read stdin from the given Reader. Must
-// be called before Start. Only one call may be made to StdinPipe or
-// SetStdinReader; subsequent calls will fail.
+// StdoutLines returns a channel on which each line of the command's stdout is
+// delivered, without its trailing newline, as soon as the line is complete. The
+// channel is closed once the process exits and all of its output has been
+// delivered, or if scanning fails, e.g. on a line longer than 1MB, in which
+// case LinesErr returns the error. Callers must receive from the channel until
+// it is closed. Must be called before Start. May be called more than once; each
+// call returns a new channel that delivers stdout from the beginning.
+func (c *Cmd) StdoutLines() <-chan string {
+	c.sh.Ok()
+	res, err := c.stdoutLines()
+	c.handleError(err)
+	return res
+}
+
+// StderrLines is like StdoutLines, but for stderr.
+func (c *Cmd) StderrLines() <-chan string {
+	c.sh.Ok()
+	res, err := c.stderrLines()
+	c.handleError(err)
+	return res
+}
+
+// LinesErr returns the first error encountered while scanning output for
+// StdoutLines or StderrLines, or nil if there was none. It should be called
+// after the channel is closed.
+func (c *Cmd) LinesErr() error {
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	return c.linesErr
+}
+
+// SetStdinReader configures this Cmd to read stdin from the given Reader. Data
+// is streamed from r to the child as the child consumes it, without being
+// buffered in memory, so r may be arbitrarily large, e.g. a multi-gigabyte
+// file; if r is an *os.File, the child reads it directly. The child's stdin is
+// closed once r returns EOF; r itself is not closed. Must be called before
+// Start. Only one call may be made to StdinPipe or SetStdinReader; subsequent
+// calls will fail.
 func (c *Cmd) SetStdinReader(r io.Reader) {
 	c.sh.Ok()
 	c.handleError(c.setStdinReader(r))
@@ -162,6 +368,40 @@ func (c *Cmd) AddStderrWriter(w io.Writer) {
 	c.handleError(c.addStderrWriter(w))
 }
 
+// SetStdoutFile configures this Cmd to write stdout directly to the given file,
+// bypassing gosh's writers, which avoids copying for commands with very large
+// output. Stdout is then not captured, propagated, tee'd, or written to
+// OutputDir, so it cannot be combined with StdoutPipe, AddStdoutWriter, Stdout,
+// and the like; Start fails if it is. The caller remains responsible for
+// closing f. Must be called before Start.
+func (c *Cmd) SetStdoutFile(f *os.File) {
+	c.sh.Ok()
+	c.handleError(c.setStdoutFile(f))
+}
+
+// SetStderrFile is like SetStdoutFile, but for stderr. Since vars are sent by
+// the child over stderr, AwaitVars is not supported if stderr is a file.
+func (c *Cmd) SetStderrFile(f *os.File) {
+	c.sh.Ok()
+	c.handleError(c.setStderrFile(f))
+}
+
+// TeeStdout is like AddStdoutWriter, but may also be called after Start, in
+// which case w only receives stdout written from then on; output the command
+// has already written is not replayed. If a Write to w fails, w receives no
+// further output, but the command's other writers are unaffected.
+func (c *Cmd) TeeStdout(w io.Writer) {
+	c.sh.Ok()
+	c.handleError(c.tee(c.stdoutTee, w))
+}
+
+// TeeStderr is like TeeStdout, but for stderr. Fails if MergeStderrIntoStdout
+// is set, since the child then has no separate stderr.
+func (c *Cmd) TeeStderr(w io.Writer) {
+	c.sh.Ok()
+	c.handleError(c.tee(c.stderrTee, w))
+}
+
 // Start starts the command.
 func (c *Cmd) Start() {
 	c.sh.Ok()
@@ -177,16 +417,163 @@ func (c *Cmd) AwaitVars(keys ...string) map[string]string {
 	return res
 }
 
-// Wait waits for the command to exit.
+// AwaitAddr waits for the child process to send a listener address using
+// AnnounceAddr, and returns it. Must not be called before Start or after Wait.
+func (c *Cmd) AwaitAddr() string {
+	c.sh.Ok()
+	res, err := c.awaitVars(addrVar)
+	c.handleError(err)
+	return res[addrVar]
+}
+
+// AwaitAddrs waits for the child process to send the addresses of the named
+// listeners using AnnounceListeners, and returns them keyed by name. Must not
+// be called before Start or after Wait.
+func (c *Cmd) AwaitAddrs(names ...string) map[string]string {
+	c.sh.Ok()
+	res, err := c.awaitAddrs(names...)
+	c.handleError(err)
+	return res
+}
+
+// AwaitHealthy calls check every interval until it returns nil, e.g. until a
+// server child accepts connections. Fails if the timeout elapses first, or if
+// the process exits first. Must not be called before Start or after Wait.
+func (c *Cmd) AwaitHealthy(check func() error, timeout, interval time.Duration) {
+	c.sh.Ok()
+	c.handleError(c.awaitHealthy(check, timeout, interval))
+}
+
+// AwaitListening waits until a TCP connection to addr succeeds, e.g. until a
+// server child is accepting connections. Fails if the timeout elapses first, or
+// if the process exits first. Must not be called before Start or after Wait.
+func (c *Cmd) AwaitListening(addr string, timeout time.Duration) {
+	c.sh.Ok()
+	c.handleError(c.awaitHealthy(func() error {
+		conn, err := net.DialTimeout("tcp", addr, awaitListeningInterval)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}, timeout, awaitListeningInterval))
+}
+
+// AwaitOutput waits until the command writes a line containing substr to its
+// stdout or stderr, e.g. until a third-party server logs that it is ready.
+// Fails if the timeout elapses first, or if the process exits first. All output
+// written since Start is examined, so the line may be written before
+// AwaitOutput is called, except that only the most recent Cmd.OutputHistory
+// bytes (64KB by default) of each stream are retained for this purpose. Must
+// not be called before Start or after Wait.
+func (c *Cmd) AwaitOutput(substr string, timeout time.Duration) {
+	c.sh.Ok()
+	_, err := c.awaitOutput(func(line string) []string {
+		if strings.Contains(line, substr) {
+			return []string{line}
+		}
+		return nil
+	}, fmt.Sprintf("containing %q", substr), timeout)
+	c.handleError(err)
+}
+
+// AwaitOutputRegexp is like AwaitOutput, but waits for a line that matches re,
+// and returns the submatches of the first such line, as returned by
+// re.FindStringSubmatch. For example, given a server that logs a line like
+// "listening on 127.0.0.1:8080", `listening on [^:]+:(\d+)` can be used to
+// extract the port.
+func (c *Cmd) AwaitOutputRegexp(re *regexp.Regexp, timeout time.Duration) []string {
+	c.sh.Ok()
+	res, err := c.awaitOutput(re.FindStringSubmatch, fmt.Sprintf("matching %q", re), timeout)
+	c.handleError(err)
+	return res
+}
+
+// awaitListeningInterval is the interval between connection attempts in
+// AwaitListening.
+const awaitListeningInterval = 50 * time.Millisecond
+
+// ReceivedVars returns a copy of all vars received so far from the child
+// process (e.g. via SendVars), without waiting for any particular vars. Unlike
+// AwaitVars, it never blocks, and may be called at any time.
+func (c *Cmd) ReceivedVars() map[string]string {
+	c.sh.Ok()
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	return copyMap(c.recvVars)
+}
+
+// ResetVars discards all vars received so far from the child process, so that
+// subsequent calls to AwaitVars wait for fresh values, e.g. after the child
+// re-initializes itself.
+func (c *Cmd) ResetVars() {
+	c.sh.Ok()
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	c.recvVars = map[string]string{}
+}
+
+// Wait waits for the command to exit. It may be called multiple times; calls
+// after the first return the same result without waiting again.
 func (c *Cmd) Wait() {
 	c.sh.Ok()
 	c.handleError(c.wait())
 }
 
-// Signal sends a signal to the underlying process.
+// WaitCh is like Wait, but returns a channel instead of blocking. Once the
+// command exits, the channel delivers the wait error (nil on success) and is
+// then closed. The error is also stored in c.Err before it is delivered, so
+// c.Err may be read once the channel delivers, but not before. Unlike Wait,
+// WaitCh does not report the wait error to Shell.HandleError; the caller is
+// responsible for handling it. Counts as a call to Wait.
+func (c *Cmd) WaitCh() <-chan error {
+	c.sh.Ok()
+	res, err := c.waitCh()
+	if err != nil {
+		c.handleError(err)
+	}
+	return res
+}
+
+// Signal sends a signal to the underlying process. If the process has already
+// exited, no signal is sent, and c.Err is set to ErrProcessExited, but the
+// error is not reported to Shell.HandleError.
 func (c *Cmd) Signal(sig os.Signal) {
 	c.sh.Ok()
-	c.handleError(c.signal(sig))
+	err := c.signal(sig)
+	if err == ErrProcessExited {
+		c.handleError(nil)
+		c.Err = err
+		return
+	}
+	c.handleError(err)
+}
+
+// PtyFile returns the master side of the command's pty, from which the child's
+// output can be read and to which its input can be written, or nil if Pty is
+// false or the command has not been started. Once the child and any other
+// processes using the pty have exited, reads fail with EIO rather than io.EOF.
+// The file is closed once the command has been waited for, e.g. by Wait or
+// Shell.Cleanup.
+func (c *Cmd) PtyFile() *os.File {
+	return c.ptyMaster
+}
+
+// SetPtySize sets the window size of the command's pty, e.g. to propagate a
+// change in the size of the parent's terminal. Must be called after Start.
+func (c *Cmd) SetPtySize(rows, cols uint16) {
+	c.sh.Ok()
+	if c.ptyMaster == nil {
+		c.handleError(errNoPty)
+		return
+	}
+	c.handleError(setPtySize(c.ptyMaster, rows, cols))
+}
+
+// Interrupt is like Signal, but sends the platform's signal for requesting
+// graceful termination, so that callers need not know which signal that is.
+// Gosh only supports Unix systems, where this is SIGINT, i.e. os.Interrupt.
+func (c *Cmd) Interrupt() {
+	c.Signal(os.Interrupt)
 }
 
 // Terminate sends a signal to the underlying process, then waits for it to
@@ -203,6 +590,46 @@ func (c *Cmd) Run() {
 	c.handleError(c.run())
 }
 
+// Success calls Start followed by Wait, then returns true iff the command
+// exited with code 0, like "if cmd; then" in a shell script. A non-zero exit
+// code is not reported to Shell.HandleError (though it is stored in c.Err);
+// other errors, e.g. failure to start, are.
+func (c *Cmd) Success() bool {
+	c.sh.Ok()
+	err := c.filterClosedPipeError(c.run())
+	if isExitError(err) {
+		c.handleError(nil)
+		c.Err = err
+		return false
+	}
+	c.handleError(err)
+	return err == nil
+}
+
+// Then waits for c, starting it first if needed, then starts next iff c exited
+// with code 0, as in "c && next" in a shell script. It returns next, so that
+// calls can be chained, e.g. a.Then(b).Else(c).Wait(). As with Success, a
+// non-zero exit code is stored in c.Err but not reported to Shell.HandleError;
+// other errors are, and cause next to be skipped.
+//
+// A skipped command is never started. Waiting for it returns the outcome of the
+// chain so far: nil if it succeeded, or else a *StageError identifying the
+// command that failed. Commands chained after a skipped command are run or
+// skipped per that outcome.
+func (c *Cmd) Then(next *Cmd) *Cmd {
+	c.sh.Ok()
+	c.sh.handleError(c.then(next, true))
+	return next
+}
+
+// Else is like Then, but starts next iff c did not succeed, as in "c || next"
+// in a shell script.
+func (c *Cmd) Else(next *Cmd) *Cmd {
+	c.sh.Ok()
+	c.sh.handleError(c.then(next, false))
+	return next
+}
+
 // Stdout calls Start followed by Wait, then returns the command's stdout.
 func (c *Cmd) Stdout() string {
 	c.sh.Ok()
@@ -229,12 +656,188 @@ func (c *Cmd) CombinedOutput() string {
 	return res
 }
 
+// OutputString is like Stdout, but removes a single trailing newline, if
+// present, which is convenient for commands that print a single line. Other
+// trailing whitespace, including "\r" and any additional newlines, is
+// preserved.
+func (c *Cmd) OutputString() string {
+	c.sh.Ok()
+	res, err := c.stdout()
+	c.handleError(err)
+	return strings.TrimSuffix(res, "\n")
+}
+
+// CombinedOutputString is like CombinedOutput, but removes a single trailing
+// newline, if present, in the same way as OutputString.
+func (c *Cmd) CombinedOutputString() string {
+	c.sh.Ok()
+	res, err := c.combinedOutput()
+	c.handleError(err)
+	return strings.TrimSuffix(res, "\n")
+}
+
+// CmdResult describes a run of a command, as returned by Cmd.Result.
+type CmdResult struct {
+	// Stdout and Stderr are the command's output.
+	Stdout string
+	Stderr string
+	// ExitCode is the exit code, or -1 if the process was terminated by a signal
+	// or did not exit.
+	ExitCode int
+	// Signal is the signal that terminated the process, or nil.
+	Signal os.Signal
+	// Duration is how long the process ran.
+	Duration time.Duration
+	// Err is the error from running the command, as stored in Cmd.Err.
+	Err error
+}
+
+// Result calls Start followed by Wait, then returns everything about the run,
+// e.g. so that the output and exit code of a command with ExitErrorIsOk set can
+// be inspected together. Errors are reported to Shell.HandleError as in
+// StdoutStderr.
+func (c *Cmd) Result() CmdResult {
+	c.sh.Ok()
+	res := c.result()
+	c.handleError(res.Err)
+	res.Err = c.Err
+	return res
+}
+
 // Pid returns the command's PID, or -1 if the command has not been started.
 func (c *Cmd) Pid() int {
 	if !c.started {
 		return -1
 	}
-	return c.c.Process.Pid
+	return c.proc.Pid()
+}
+
+// Done returns true iff the command was started and its process has exited.
+// Unlike Wait, it never blocks and does not count as a call to Wait, so it may
+// be used to poll for exit, e.g. before sending a signal.
+func (c *Cmd) Done() bool {
+	return c.processState() != nil
+}
+
+// ExitCode returns the command's exit code, or -1 if the command has not exited
+// or was terminated by a signal.
+func (c *Cmd) ExitCode() int {
+	if ps := c.processState(); ps != nil {
+		return ps.ExitCode()
+	}
+	return -1
+}
+
+// Signaled returns the signal that terminated the command, and true, if the
+// command was terminated by a signal. Otherwise, e.g. if the command exited
+// normally or has not exited, it returns nil and false.
+func (c *Cmd) Signaled() (os.Signal, bool) {
+	ps := c.processState()
+	if ps == nil {
+		return nil, false
+	}
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return ws.Signal(), true
+	}
+	return nil, false
+}
+
+// CmdDescription describes how a command is (or would be) run. It is meant to
+// be JSON-encoded, e.g. to help reproduce a failed command.
+type CmdDescription struct {
+	// Path is the resolved path of the executable, or of Cmd.Wrapper[0] if set.
+	Path string
+	// Args is the full argv, including Cmd.Wrapper if set.
+	Args []string
+	// Dir is the working directory.
+	Dir string
+	// Env is the full env, including gosh control vars.
+	Env map[string]string
+}
+
+// Describe returns a description of how this command is (or would be) run.
+func (c *Cmd) Describe() CmdDescription {
+	env := c.env()
+	path, args, _ := c.argv(env)
+	dir := c.c.Dir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	return CmdDescription{Path: path, Args: args, Dir: dir, Env: env}
+}
+
+// EnvDiff returns the differences between the env this command's process runs
+// (or would run) with and the env of the current process, per os.Environ. These
+// are the changes introduced by gosh, i.e. Shell.Vars, Cmd.Vars, Cmd.ClearEnv,
+// and gosh control vars. Vars in changed map to their new values, and vars in
+// removed map to their old values.
+func (c *Cmd) EnvDiff() (added, changed, removed map[string]string) {
+	return diffEnv(sliceToMap(os.Environ()), c.env())
+}
+
+// String returns a shell command line for this command, prefixed by the vars
+// in Cmd.Vars that were added or changed since NewShell. Vars inherited from
+// the environment of the current process are omitted, since they may hold
+// secrets; inherited vars removed from Cmd.Vars are shown as "env -u" args,
+// and Cmd.ClearEnv is shown as "env -i". For commands created by
+// Shell.FuncCmd, the opaque invocation var is omitted, and a trailing comment
+// shows the function name and arguments.
+func (c *Cmd) String() string {
+	vars := c.sh.varOverrides(c.Vars)
+	delete(vars, envInvocation)
+	delete(vars, envInvocationFile)
+	delete(vars, envSendResult)
+	var parts []string
+	if c.ClearEnv && !c.exactEnv {
+		parts = append(parts, "env", "-i")
+	} else {
+		var unset []string
+		for k := range c.sh.inheritedVars {
+			if _, ok := c.Vars[k]; !ok {
+				unset = append(unset, k)
+			}
+		}
+		if len(unset) > 0 {
+			sort.Strings(unset)
+			parts = append(parts, "env")
+			for _, k := range unset {
+				parts = append(parts, "-u", shellQuote(k))
+			}
+		}
+	}
+	for _, kv := range mapToSlice(vars) {
+		k, v := splitKeyValue(kv)
+		parts = append(parts, joinKeyValue(k, shellQuote(v)))
+	}
+	_, args, _ := c.argv(c.env())
+	for _, arg := range args {
+		parts = append(parts, shellQuote(arg))
+	}
+	res := strings.Join(parts, " ")
+	if name, args := c.funcInvocation(); name != "" {
+		strs := make([]string, len(args))
+		for i, arg := range args {
+			strs[i] = fmt.Sprintf("%#v", arg)
+		}
+		res += fmt.Sprintf(" # %s(%s)", name, strings.Join(strs, ", "))
+	}
+	return res
+}
+
+// FuncName returns the name of the registered Func invoked by this command, or
+// "" if this command was not created by Shell.FuncCmd.
+func (c *Cmd) FuncName() string {
+	name, _ := c.funcInvocation()
+	return name
+}
+
+// FuncArgs returns the arguments passed to the registered Func invoked by this
+// command, or nil if this command was not created by Shell.FuncCmd. The
+// arguments are decoded from the encoded invocation, so they reflect exactly
+// what the child will receive.
+func (c *Cmd) FuncArgs() []interface{} {
+	_, args := c.funcInvocation()
+	return args
 }
 
 ////////////////////////////////////////
@@ -251,9 +854,14 @@ func newCmdInternal(sh *Shell, vars map[string]string, path string, args []strin
 		c:              &exec.Cmd{},
 		cond:           sync.NewCond(&sync.Mutex{}),
 		waitChan:       make(chan error, 1),
+		exitedChan:     make(chan struct{}),
 		stdoutHeadTail: newHeadTail(headTailCapacity),
 		stderrHeadTail: newHeadTail(headTailCapacity),
+		stdoutTee:      &teeWriter{},
+		stderrTee:      &teeWriter{},
 		recvVars:       map[string]string{},
+		backend:        sh.Backend,
+		runner:         sh.Runner,
 	}
 	// Protect against concurrent signal-triggered Shell.cleanup().
 	sh.cleanupMu.Lock()
@@ -266,19 +874,19 @@ func newCmdInternal(sh *Shell, vars map[string]string, path string, args []strin
 }
 
 func newCmd(sh *Shell, vars map[string]string, name string, args ...string) (*Cmd, error) {
-	// Mimics https://golang.org/src/os/exec/exec.go Command.
-	if filepath.Base(name) == name {
-		lp, err := lookpath.Look(sh.Vars, name)
-		if err != nil {
-			return nil, fmt.Errorf("gosh: failed to locate executable: %s", name)
+	// Resolve name using the env the child will run with. With a backend, the
+	// child's env is not local, so the backend resolves name instead.
+	if sh.Backend == nil {
+		var err error
+		if name, err = lookPath(sh.childEnv(vars), name); err != nil {
+			return nil, err
 		}
-		name = lp
 	}
 	return newCmdInternal(sh, vars, name, args)
 }
 
 func isExitError(err error) bool {
-	_, ok := err.(*exec.ExitError)
+	_, ok := err.(*ExitError)
 	return ok
 }
 
@@ -305,6 +913,13 @@ func (c *Cmd) errorIsOk(err error) bool {
 // exited with a zero exit code, and Write on the io.MultiWriter in the parent
 // process received the closed pipe error.
 //
+// Some programs (e.g. Python scripts) exit with a non-zero exit code rather
+// than dying from SIGPIPE when writing to a closed pipe. If Write in the parent
+// process received a closed pipe error, the exec package closes the child's end
+// of the pipe, so the child's subsequent writes fail. Thus, with
+// IgnoreClosedPipeError, we also ignore ExitErrors from processes whose output
+// the parent failed to write to a closed pipe.
+//
 // Starting in go 1.6, by default all go programs will exit with SIGPIPE if they
 // try to write to a broken os.Stdout or os.Stderr. This is the behavior we
 // want; it means that normal go programs will behave as expected wrt
@@ -313,9 +928,7 @@ func (c *Cmd) errorIsOk(err error) bool {
 var sep = strings.Repeat("-", 40)
 
 func (c *Cmd) handleError(err error) {
-	if c.IgnoreClosedPipeError && isClosedPipeError(err) {
-		err = nil
-	}
+	err = c.filterClosedPipeError(err)
 	c.Err = err
 	if c.errorIsOk(err) {
 		err = nil
@@ -328,6 +941,23 @@ func (c *Cmd) handleError(err error) {
 	c.sh.HandleErrorWithSkip(err, 3)
 }
 
+// filterClosedPipeError returns nil if err should be ignored per
+// IgnoreClosedPipeError, and err otherwise.
+func (c *Cmd) filterClosedPipeError(err error) error {
+	if c.IgnoreClosedPipeError && (isClosedPipeError(err) || c.exitedAfterClosedPipe(err)) {
+		return nil
+	}
+	return err
+}
+
+// exitedAfterClosedPipe returns true iff the process exited with a non-zero
+// exit code after the parent failed to copy its output to a closed pipe. Note,
+// the exec package closes the child's stdout and stderr once copying fails, so
+// such a process likely failed because its own writes failed.
+func (c *Cmd) exitedAfterClosedPipe(err error) bool {
+	return isExitError(err) && atomic.LoadInt32(&c.sawClosedPipe) == 1
+}
+
 func (c *Cmd) isRunning() bool {
 	if !c.started {
 		return false
@@ -337,16 +967,56 @@ func (c *Cmd) isRunning() bool {
 	return !c.exited
 }
 
+// processState returns the state of the exited process, or nil if the process
+// has not exited.
+func (c *Cmd) processState() ProcessState {
+	if !c.started {
+		return nil
+	}
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	if !c.exited {
+		return nil
+	}
+	return c.state
+}
+
 // recvWriter listens for gosh vars from a child process.
 type recvWriter struct {
 	c             *Cmd
+	prefix        []byte
+	suffix        []byte
 	buf           []byte
 	matchedPrefix int
 	matchedSuffix int
 }
 
+func newRecvWriter(c *Cmd) *recvWriter {
+	prefix, suffix := varsMarkers(c.sh.VarsTag)
+	return &recvWriter{c: c, prefix: prefix, suffix: suffix}
+}
+
 func (w *recvWriter) Write(p []byte) (n int, err error) {
-	for i, b := range p {
+	varsPrefix, varsSuffix := w.prefix, w.suffix
+	for i := 0; i < len(p); i++ {
+		// Skip ahead in bulk to the next byte that could start a prefix or suffix
+		// match, so that ordinary output isn't examined a byte at a time.
+		if w.matchedPrefix == 0 {
+			j := bytes.IndexByte(p[i:], varsPrefix[0])
+			if j < 0 {
+				break
+			}
+			i += j
+		} else if w.matchedPrefix == len(varsPrefix) && w.matchedSuffix == 0 {
+			j := bytes.IndexByte(p[i:], varsSuffix[0])
+			if j < 0 {
+				w.buf = append(w.buf, p[i:]...)
+				break
+			}
+			w.buf = append(w.buf, p[i:i+j]...)
+			i += j
+		}
+		b := p[i]
 		if w.matchedPrefix < len(varsPrefix) {
 			// Look for matching prefix.
 			if b != varsPrefix[w.matchedPrefix] {
@@ -374,7 +1044,7 @@ func (w *recvWriter) Write(p []byte) (n int, err error) {
 		w.matchedPrefix, w.matchedSuffix = 0, 0
 		vars := make(map[string]string)
 		if err := json.Unmarshal(data, &vars); err != nil {
-			return i, err
+			return i, &ProtocolError{Err: err}
 		}
 		w.c.cond.L.Lock()
 		w.c.recvVars = mergeMaps(w.c.recvVars, vars)
@@ -385,30 +1055,76 @@ func (w *recvWriter) Write(p []byte) (n int, err error) {
 }
 
 func (c *Cmd) makeStdoutStderr() (io.Writer, io.Writer, error) {
-	c.stderrWriters = append(c.stderrWriters, &recvWriter{c: c})
-	c.stdoutWriters = append(c.stdoutWriters, c.stdoutHeadTail)
-	c.stderrWriters = append(c.stderrWriters, c.stderrHeadTail)
+	if c.stdoutFile != nil && len(c.stdoutWriters) > 0 || c.stderrFile != nil && len(c.stderrWriters) > 0 {
+		return nil, nil, errFileWithWriters
+	}
+	if c.MergeStderrIntoStdout && (c.stderrFile != nil || len(c.stderrWriters) > 0 || c.stderrTee.numWriters() > 0) {
+		return nil, nil, errMergeStderrWithIO
+	}
+	stdout, stderr, err := c.makeStdoutStderrWriters()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Streams set to files bypass the writers.
+	if c.stdoutFile != nil {
+		stdout = c.stdoutFile
+	}
+	if c.stderrFile != nil {
+		stderr = c.stderrFile
+	}
+	return stdout, stderr, nil
+}
+
+// makeStdoutStderrWriters returns writers that fan out the child's stdout and
+// stderr to all configured destinations. If MergeStderrIntoStdout is set, no
+// stderr writers are built, and the returned stderr writer is nil.
+func (c *Cmd) makeStdoutStderrWriters() (io.Writer, io.Writer, error) {
+	merge := c.MergeStderrIntoStdout
+	// The child sends vars to its stderr, which may be its stdout.
+	if merge {
+		c.stdoutWriters = append(c.stdoutWriters, newRecvWriter(c))
+	} else {
+		c.stderrWriters = append(c.stderrWriters, newRecvWriter(c))
+	}
+	history := c.OutputHistory
+	if history == 0 {
+		history = defaultOutputHistory
+	}
+	c.stdoutTee.setHistoryCapacity(history)
+	c.stdoutWriters = append(c.stdoutWriters, c.stdoutHeadTail, c.stdoutTee)
+	if !merge {
+		c.stderrTee.setHistoryCapacity(history)
+		c.stderrWriters = append(c.stderrWriters, c.stderrHeadTail, c.stderrTee)
+	}
 	if c.PropagateOutput {
-		c.stdoutWriters = append(c.stdoutWriters, os.Stdout)
-		c.stderrWriters = append(c.stderrWriters, os.Stderr)
+		var stdout, stderr io.Writer = os.Stdout, os.Stderr
+		if c.sh.Stdout != nil {
+			stdout = c.sh.Stdout
+		}
+		if c.sh.Stderr != nil {
+			stderr = c.sh.Stderr
+		}
+		if c.LogOutput {
+			stdoutLog, stderrLog := c.newLogWriter("INFO"), c.newLogWriter("WARN")
+			c.afterWaitClosers = append(c.afterWaitClosers, stdoutLog, stderrLog)
+			stdout, stderr = stdoutLog, stderrLog
+		}
+		if c.TimestampOutput {
+			stdout, stderr = newTimestampWriter(stdout, c.sh.clock()), newTimestampWriter(stderr, c.sh.clock())
+		}
+		c.stdoutWriters = append(c.stdoutWriters, stdout)
+		if !merge {
+			c.stderrWriters = append(c.stderrWriters, stderr)
+		}
 	}
 	if c.OutputDir != "" {
-		t := time.Now().Format("20060102.150405.000000")
-		name := filepath.Join(c.OutputDir, filepath.Base(c.Path)+"."+t)
-		const flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
-		switch file, err := os.OpenFile(name+".stdout", flags, 0600); {
-		case err != nil:
+		stdout, stderr, err := c.openOutputFiles(c.CompressOutput)
+		if err != nil {
 			return nil, nil, err
-		default:
-			c.stdoutWriters = append(c.stdoutWriters, file)
-			c.afterWaitClosers = append(c.afterWaitClosers, file)
 		}
-		switch file, err := os.OpenFile(name+".stderr", flags, 0600); {
-		case err != nil:
-			return nil, nil, err
-		default:
-			c.stderrWriters = append(c.stderrWriters, file)
-			c.afterWaitClosers = append(c.afterWaitClosers, file)
+		c.stdoutWriters = append(c.stdoutWriters, stdout)
+		if stderr != nil {
+			c.stderrWriters = append(c.stderrWriters, stderr)
 		}
 	}
 	switch hasOut, hasErr := len(c.stdoutWriters) > 0, len(c.stderrWriters) > 0; {
@@ -417,64 +1133,451 @@ func (c *Cmd) makeStdoutStderr() (io.Writer, io.Writer, error) {
 		// writers that capture both will see the same ordering, and don't need to
 		// worry about concurrent writes.
 		sharedMu := &sync.Mutex{}
-		stdout := &sharedLockWriter{sharedMu, io.MultiWriter(c.stdoutWriters...)}
-		stderr := &sharedLockWriter{sharedMu, io.MultiWriter(c.stderrWriters...)}
+		stdout := &sharedLockWriter{sharedMu, c.multiWriter(c.stdoutWriters)}
+		stderr := &sharedLockWriter{sharedMu, c.multiWriter(c.stderrWriters)}
 		return stdout, stderr, nil
 	case hasOut:
-		return io.MultiWriter(c.stdoutWriters...), nil, nil
+		return c.multiWriter(c.stdoutWriters), nil, nil
 	case hasErr:
-		return nil, io.MultiWriter(c.stderrWriters...), nil
+		return nil, c.multiWriter(c.stderrWriters), nil
 	}
 	return nil, nil, nil
 }
 
-type sharedLockWriter struct {
-	mu *sync.Mutex
-	w  io.Writer
+// openOutputFiles creates files in OutputDir for the child's stdout and stderr.
+// The files are closed after the process exits. Until the process starts, they
+// are named "<base>.<timestamp>.<random>.stdout" and
+// "<base>.<timestamp>.<random>.stderr", so that commands started at the same
+// time do not collide; renameOutputFiles then replaces the random part with the
+// PID. If MergeStderrIntoStdout is set, no stderr file is created, and the
+// returned stderr writer is nil. If compress is true, the returned writers gzip
+// their output, and the names gain a ".gz" suffix; otherwise, the returned
+// writers are the *os.File objects.
+func (c *Cmd) openOutputFiles(compress bool) (io.Writer, io.Writer, error) {
+	if err := os.MkdirAll(c.OutputDir, 0700); err != nil {
+		return nil, nil, fmt.Errorf("gosh: failed to create Cmd.OutputDir: %v", err)
+	}
+	c.outputStamp = c.sh.clock().Now().Format("20060102.150405.000000")
+	prefix := filepath.Base(c.Path) + "." + c.outputStamp + "."
+	open := func(suffix string) (io.Writer, error) {
+		if compress {
+			suffix += ".gz"
+		}
+		f, err := ioutil.TempFile(c.OutputDir, prefix+"*"+suffix)
+		if err != nil {
+			return nil, err
+		}
+		c.outputFiles = append(c.outputFiles, f.Name())
+		if !compress {
+			c.afterWaitClosers = append(c.afterWaitClosers, f)
+			return f, nil
+		}
+		w := &gzipFile{gzip.NewWriter(f), f}
+		c.afterWaitClosers = append(c.afterWaitClosers, w)
+		return w, nil
+	}
+	stdout, err := open(".stdout")
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.MergeStderrIntoStdout {
+		return stdout, nil, nil
+	}
+	stderr, err := open(".stderr")
+	if err != nil {
+		return nil, nil, err
+	}
+	return stdout, stderr, nil
 }
 
-func (w *sharedLockWriter) Write(p []byte) (int, error) {
-	w.mu.Lock()
-	n, err := w.w.Write(p)
-	w.mu.Unlock()
-	return n, err
+// gzipFile is a gzip.Writer that writes to a file. Close flushes the gzip
+// stream, then closes the file.
+type gzipFile struct {
+	*gzip.Writer
+	f *os.File
 }
 
-func (c *Cmd) clone() (*Cmd, error) {
-	args := make([]string, len(c.Args))
-	copy(args, c.Args)
-	res, err := newCmdInternal(c.sh, copyMap(c.Vars), c.Path, args[1:])
-	if err != nil {
-		return nil, err
+func (w *gzipFile) Close() error {
+	err := w.Writer.Close()
+	if err2 := w.f.Close(); err == nil {
+		err = err2
 	}
-	res.IgnoreParentExit = c.IgnoreParentExit
-	res.ExitAfter = c.ExitAfter
-	res.PropagateOutput = c.PropagateOutput
-	res.OutputDir = c.OutputDir
-	res.ExitErrorIsOk = c.ExitErrorIsOk
-	res.IgnoreClosedPipeError = c.IgnoreClosedPipeError
-	return res, nil
+	return err
 }
 
-func (c *Cmd) stdinPipe() (io.WriteCloser, error) {
-	switch {
-	case c.calledStart:
-		return nil, errAlreadyCalledStart
-	case c.c.Stdin != nil:
-		return nil, errAlreadySetStdin
+// renameOutputFiles renames the files created by openOutputFiles to
+// "<base>.<pid>.<timestamp>.stdout" and "<base>.<pid>.<timestamp>.stderr", so
+// that they can be traced to the process that wrote them. Must be called after
+// the process has started. The process may continue to write to the files
+// after they are renamed.
+func (c *Cmd) renameOutputFiles() error {
+	base := filepath.Base(c.Path)
+	prefix := base + "." + c.outputStamp + "."
+	for i, name := range c.outputFiles {
+		// Drop the random part, which contains no dots.
+		rest := strings.TrimPrefix(filepath.Base(name), prefix)
+		suffix := rest[strings.IndexByte(rest, '.'):]
+		newName := filepath.Join(filepath.Dir(name), base+"."+strconv.Itoa(c.Pid())+"."+c.outputStamp+suffix)
+		if err := os.Rename(name, newName); err != nil {
+			return err
+		}
+		c.outputFiles[i] = newName
 	}
-	// We want to provide an unlimited-size pipe to the user. If we set c.c.Stdin
-	// directly to the newBufferedPipe, the os/exec package will create an os.Pipe
-	// for us, along with a goroutine to copy data over. And exec.Cmd.Wait will
-	// wait for this goroutine to exit before returning, even if the process has
-	// already exited. That means the user will be forced to call Close on the
-	// returned WriteCloser, which is annoying.
-	//
-	// Instead, we set c.c.Stdin to our own os.Pipe, so that os/exec won't create
-	// the pipe nor the goroutine. We chain our newBufferedPipe in front of this,
-	// with our own copier goroutine. This gives the user a pipe that never blocks
-	// on Write, and which they don't need to Close if the process exits.
-	pr, pw, err := os.Pipe()
+	return nil
+}
+
+// makeDetachedStdoutStderr configures stdout and stderr for a detached child.
+// The child writes directly to the files set by SetStdoutFile and
+// SetStderrFile, or to files in OutputDir if set, and to /dev/null otherwise,
+// so that it never writes to a pipe read by the parent.
+func (c *Cmd) makeDetachedStdoutStderr() error {
+	if c.c.Stdin != nil || len(c.stdoutWriters) > 0 || len(c.stderrWriters) > 0 {
+		return errDetachedWithIO
+	}
+	if c.MergeStderrIntoStdout && c.stderrFile != nil {
+		return errMergeStderrWithIO
+	}
+	if c.OutputDir != "" {
+		stdout, stderr, err := c.openOutputFiles(false)
+		if err != nil {
+			return err
+		}
+		c.c.Stdout, c.c.Stderr = stdout, stderr
+	}
+	if c.stdoutFile != nil {
+		c.c.Stdout = c.stdoutFile
+	}
+	if c.stderrFile != nil {
+		c.c.Stderr = c.stderrFile
+	}
+	return nil
+}
+
+// makePtyStdio allocates a pty and connects the child's stdin, stdout, and
+// stderr to it. The pty's size is copied from the parent's stdin, if that is a
+// terminal. The parent's copy of the slave side is closed after the process
+// starts; the master side is closed once the command is reaped.
+func (c *Cmd) makePtyStdio() error {
+	if c.Detached || c.c.Stdin != nil || len(c.stdoutWriters) > 0 || len(c.stderrWriters) > 0 || c.stdoutFile != nil || c.stderrFile != nil {
+		return errPtyWithIO
+	}
+	master, slave, err := openPty()
+	if err != nil {
+		return err
+	}
+	c.ptyMaster = master
+	c.afterStartClosers = append(c.afterStartClosers, slave)
+	if rows, cols, err := getPtySize(os.Stdin); err == nil {
+		if err := setPtySize(master, rows, cols); err != nil {
+			return err
+		}
+	}
+	c.c.Stdin, c.c.Stdout, c.c.Stderr = slave, slave, slave
+	return nil
+}
+
+// multiWriter returns an io.MultiWriter for the given writers that records
+// closed pipe errors in c.sawClosedPipe.
+func (c *Cmd) multiWriter(writers []io.Writer) io.Writer {
+	return &closedPipeWriter{c: c, w: io.MultiWriter(writers...)}
+}
+
+type closedPipeWriter struct {
+	c *Cmd
+	w io.Writer
+}
+
+func (w *closedPipeWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil && isClosedPipeError(err) {
+		atomic.StoreInt32(&w.c.sawClosedPipe, 1)
+	}
+	return n, err
+}
+
+// teeWriter writes to a set of writers that may grow while writes are in
+// progress. Writers that fail are dropped, and errors are never returned. It
+// also retains at least the most recent historyCapacity bytes of output, so
+// that writers added via addWithHistory see output written before they were
+// added. Older output is discarded a line at a time.
+type teeWriter struct {
+	mu              sync.Mutex
+	writers         []io.Writer
+	history         []byte
+	historyCapacity int // no output is retained if <= 0
+}
+
+// defaultOutputHistory is the default value of Cmd.OutputHistory.
+const defaultOutputHistory = 1 << 16
+
+// numWriters returns the number of writers.
+func (w *teeWriter) numWriters() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.writers)
+}
+
+// setHistoryCapacity sets the amount of output retained.
+func (w *teeWriter) setHistoryCapacity(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.historyCapacity = n
+}
+
+func (w *teeWriter) add(x io.Writer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writers = append(w.writers, x)
+}
+
+// addWithHistory is like add, but first writes the retained output to x. If
+// that write fails, x is not added.
+func (w *teeWriter) addWithHistory(x io.Writer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.history) > 0 {
+		if _, err := x.Write(w.history); err != nil {
+			return
+		}
+	}
+	w.writers = append(w.writers, x)
+}
+
+// dropHistory discards the retained output, and stops retaining output.
+func (w *teeWriter) dropHistory() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.history, w.historyCapacity = nil, 0
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.historyCapacity > 0 {
+		w.history = append(w.history, p...)
+		// To avoid copying on every write, only discard output once twice the
+		// capacity is retained.
+		if len(w.history) > 2*w.historyCapacity {
+			// Discard whole lines, so that the retained output starts at a line.
+			// Searching from excess-1 keeps a line that starts exactly at excess.
+			excess := len(w.history) - w.historyCapacity
+			i := bytes.IndexByte(w.history[excess-1:], '\n')
+			if i < 0 {
+				w.history = w.history[:0]
+			} else {
+				w.history = append(w.history[:0], w.history[excess+i:]...)
+			}
+		}
+	}
+	keep := w.writers[:0]
+	for _, x := range w.writers {
+		if _, err := x.Write(p); err == nil {
+			keep = append(keep, x)
+		}
+	}
+	w.writers = keep
+	return len(p), nil
+}
+
+type sharedLockWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w *sharedLockWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	n, err := w.w.Write(p)
+	w.mu.Unlock()
+	return n, err
+}
+
+// timestampWriter prefixes each line written to w with the time at which the
+// first byte of the line was written. Partial lines are passed through
+// immediately; the next timestamp is written once the line is completed.
+type timestampWriter struct {
+	w           io.Writer
+	clock       Clock
+	atLineStart bool
+}
+
+func newTimestampWriter(w io.Writer, clock Clock) *timestampWriter {
+	return &timestampWriter{w: w, clock: clock, atLineStart: true}
+}
+
+func (w *timestampWriter) Write(p []byte) (int, error) {
+	var buf []byte
+	for rest := p; len(rest) > 0; {
+		if w.atLineStart {
+			buf = w.clock.Now().AppendFormat(buf, time.RFC3339Nano)
+			buf = append(buf, ' ')
+			w.atLineStart = false
+		}
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line, w.atLineStart = rest[:i+1], true
+		}
+		buf = append(buf, line...)
+		rest = rest[len(line):]
+	}
+	if _, err := w.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// errStopMatching is returned by lineMatcher.Write once the matcher is done, so
+// that teeWriter drops it.
+var errStopMatching = errors.New("gosh: stopped matching")
+
+// lineMatcher passes each complete line written to it to match, and sends the
+// first non-nil result on found, without blocking. Lines longer than
+// maxLineSize are truncated. Once a match is found or stop is called, writes
+// fail with errStopMatching.
+type lineMatcher struct {
+	mu      sync.Mutex
+	match   func(line string) []string
+	found   chan<- []string
+	buf     []byte
+	stopped bool
+}
+
+func (w *lineMatcher) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := len(p)
+	for len(p) > 0 && !w.stopped {
+		line := p
+		i := bytes.IndexByte(p, '\n')
+		if i >= 0 {
+			line = p[:i]
+		}
+		if n := maxLineSize - len(w.buf); len(line) > n {
+			line = line[:n]
+		}
+		w.buf = append(w.buf, line...)
+		if i < 0 {
+			break
+		}
+		p = p[i+1:]
+		if res := w.match(string(w.buf)); res != nil {
+			select {
+			case w.found <- res:
+			default:
+			}
+			w.stopped = true
+		}
+		w.buf = w.buf[:0]
+	}
+	if w.stopped {
+		return 0, errStopMatching
+	}
+	return n, nil
+}
+
+func (w *lineMatcher) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+}
+
+// logWriter logs each line written to it via the Shell's TB.Logf, tagged with
+// the given level and the command's name. Partial lines are buffered until they
+// are completed, or until Close is called.
+type logWriter struct {
+	c     *Cmd
+	level string
+	buf   []byte
+}
+
+func (c *Cmd) newLogWriter(level string) *logWriter {
+	return &logWriter{c: c, level: level}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.log(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close logs any buffered partial line.
+func (w *logWriter) Close() error {
+	if len(w.buf) > 0 {
+		w.log(w.buf)
+		w.buf = nil
+	}
+	return nil
+}
+
+func (w *logWriter) log(line []byte) {
+	w.c.sh.tb.Logf("%s %s: %s\n", w.level, filepath.Base(w.c.Path), line)
+}
+
+func (c *Cmd) clone() (*Cmd, error) {
+	args := make([]string, len(c.Args))
+	copy(args, c.Args)
+	res, err := newCmdInternal(c.sh, copyMap(c.Vars), c.Path, args[1:])
+	if err != nil {
+		return nil, err
+	}
+	res.IgnoreParentExit = c.IgnoreParentExit
+	res.ExitAfter = c.ExitAfter
+	res.PropagateOutput = c.PropagateOutput
+	res.TimestampOutput = c.TimestampOutput
+	res.LogOutput = c.LogOutput
+	res.OutputDir = c.OutputDir
+	res.CompressOutput = c.CompressOutput
+	res.OutputHistory = c.OutputHistory
+	res.ExitErrorIsOk = c.ExitErrorIsOk
+	res.IgnoreClosedPipeError = c.IgnoreClosedPipeError
+	res.Nice = c.Nice
+	res.Limits = c.Limits
+	if c.Credential != nil {
+		cred := *c.Credential
+		res.Credential = &cred
+	}
+	if c.SysProcAttr != nil {
+		attr := *c.SysProcAttr
+		res.SysProcAttr = &attr
+	}
+	res.ClearEnv = c.ClearEnv
+	res.exactEnv = c.exactEnv
+	res.InheritStdin = c.InheritStdin
+	res.MergeStderrIntoStdout = c.MergeStderrIntoStdout
+	res.Pty = c.Pty
+	res.Detached = c.Detached
+	res.Context = c.Context
+	res.Wrapper = append([]string(nil), c.Wrapper...)
+	res.backend = c.backend
+	res.runner = c.runner
+	return res, nil
+}
+
+func (c *Cmd) stdinPipe() (io.WriteCloser, error) {
+	switch {
+	case c.calledStart:
+		return nil, errAlreadyCalledStart
+	case c.c.Stdin != nil:
+		return nil, errAlreadySetStdin
+	}
+	// We want to provide an unlimited-size pipe to the user. If we set c.c.Stdin
+	// directly to the newBufferedPipe, the os/exec package will create an os.Pipe
+	// for us, along with a goroutine to copy data over. And exec.Cmd.Wait will
+	// wait for this goroutine to exit before returning, even if the process has
+	// already exited. That means the user will be forced to call Close on the
+	// returned WriteCloser, which is annoying.
+	//
+	// Instead, we set c.c.Stdin to our own os.Pipe, so that os/exec won't create
+	// the pipe nor the goroutine. We chain our newBufferedPipe in front of this,
+	// with our own copier goroutine. This gives the user a pipe that never blocks
+	// on Write, and which they don't need to Close if the process exits.
+	pr, pw, err := os.Pipe()
 	if err != nil {
 		return nil, err
 	}
@@ -502,18 +1605,22 @@ func (c *Cmd) stdinPipeCopier(dst io.WriteCloser, src io.Reader) {
 // typically occurs with a pipeline of commands "A | B"; if B exits first, the
 // next write by A will receive a closed pipe error. Also see:
 // https://github.com/golang/go/issues/9173
+//
+// Wrapped errors are recognized, per errors.Is and errors.As.
 func isClosedPipeError(err error) bool {
-	if err == io.ErrClosedPipe {
+	if errors.Is(err, io.ErrClosedPipe) {
 		return true
 	}
 	// Closed pipe on os.Pipe; mirrors logic in os/exec/exec_posix.go.
-	if pe, ok := err.(*os.PathError); ok {
-		if pe.Op == "write" && pe.Path == "|1" && pe.Err == syscall.EPIPE {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		if pe.Op == "write" && pe.Path == "|1" && errors.Is(pe.Err, syscall.EPIPE) {
 			return true
 		}
 	}
 	// Process exited due to a SIGPIPE signal.
-	if ee, ok := err.(*exec.ExitError); ok {
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
 		if ws, ok := ee.ProcessState.Sys().(syscall.WaitStatus); ok {
 			if ws.Signaled() && ws.Signal() == syscall.SIGPIPE {
 				return true
@@ -538,20 +1645,85 @@ func (c *Cmd) stdoutPipe() (io.ReadCloser, error) {
 	if c.calledStart {
 		return nil, errAlreadyCalledStart
 	}
-	p := newBufferedPipe()
-	c.stdoutWriters = append(c.stdoutWriters, p)
-	c.afterWaitClosers = append(c.afterWaitClosers, p)
-	return p, nil
+	return c.stdoutCap().newReader(), nil
 }
 
 func (c *Cmd) stderrPipe() (io.ReadCloser, error) {
 	if c.calledStart {
 		return nil, errAlreadyCalledStart
 	}
-	p := newBufferedPipe()
-	c.stderrWriters = append(c.stderrWriters, p)
-	c.afterWaitClosers = append(c.afterWaitClosers, p)
-	return p, nil
+	return c.stderrCap().newReader(), nil
+}
+
+func (c *Cmd) stdoutLines() (<-chan string, error) {
+	r, err := c.stdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	return c.scanLines(r), nil
+}
+
+func (c *Cmd) stderrLines() (<-chan string, error) {
+	r, err := c.stderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	return c.scanLines(r), nil
+}
+
+// maxLineSize is the maximum size of a line delivered by StdoutLines and
+// StderrLines.
+const maxLineSize = 1 << 20
+
+// scanLines spawns a goroutine that scans lines from r and sends them on the
+// returned channel, which is closed once r is exhausted or scanning fails. Scan
+// errors are recorded in c.linesErr.
+func (c *Cmd) scanLines(r io.Reader) <-chan string {
+	ch := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 4096), maxLineSize)
+		for scanner.Scan() {
+			ch <- scanner.Text()
+		}
+		err := scanner.Err()
+		if err != nil {
+			c.cond.L.Lock()
+			if c.linesErr == nil {
+				c.linesErr = err
+			}
+			c.cond.L.Unlock()
+		}
+		close(ch)
+		if err != nil {
+			// Drain the rest of the stream rather than closing it, since closing a
+			// pipe makes subsequent writes to the stream fail.
+			io.Copy(ioutil.Discard, r)
+		}
+	}()
+	return ch
+}
+
+// stdoutCap returns the capture for stdout, creating it if needed. All
+// accessors that buffer stdout share this capture.
+func (c *Cmd) stdoutCap() *capture {
+	if c.stdoutCapture == nil {
+		c.stdoutCapture = newCapture()
+		c.stdoutWriters = append(c.stdoutWriters, c.stdoutCapture)
+		c.afterWaitClosers = append(c.afterWaitClosers, c.stdoutCapture)
+	}
+	return c.stdoutCapture
+}
+
+// stderrCap returns the capture for stderr, creating it if needed. All
+// accessors that buffer stderr share this capture.
+func (c *Cmd) stderrCap() *capture {
+	if c.stderrCapture == nil {
+		c.stderrCapture = newCapture()
+		c.stderrWriters = append(c.stderrWriters, c.stderrCapture)
+		c.afterWaitClosers = append(c.afterWaitClosers, c.stderrCapture)
+	}
+	return c.stderrCapture
 }
 
 func (c *Cmd) addStdoutWriter(w io.Writer) error {
@@ -562,6 +1734,39 @@ func (c *Cmd) addStdoutWriter(w io.Writer) error {
 	return nil
 }
 
+func (c *Cmd) setStdoutFile(f *os.File) error {
+	switch {
+	case c.calledStart:
+		return errAlreadyCalledStart
+	case len(c.stdoutWriters) > 0:
+		return errFileWithWriters
+	}
+	c.stdoutFile = f
+	return nil
+}
+
+func (c *Cmd) setStderrFile(f *os.File) error {
+	switch {
+	case c.calledStart:
+		return errAlreadyCalledStart
+	case len(c.stderrWriters) > 0:
+		return errFileWithWriters
+	}
+	c.stderrFile = f
+	return nil
+}
+
+func (c *Cmd) tee(t *teeWriter, w io.Writer) error {
+	switch {
+	case c.calledWait:
+		return errAlreadyCalledWait
+	case t == c.stderrTee && c.MergeStderrIntoStdout:
+		return errMergeStderrWithIO
+	}
+	t.add(w)
+	return nil
+}
+
 func (c *Cmd) addStderrWriter(w io.Writer) error {
 	if c.calledStart {
 		return errAlreadyCalledStart
@@ -585,12 +1790,28 @@ func (c *Cmd) start() (e error) {
 			if err := closeClosers(c.afterWaitClosers); e == nil {
 				e = err
 			}
+			// If start succeeds, the pty is closed once the command is reaped.
+			if c.ptyMaster != nil {
+				c.ptyMaster.Close()
+				c.ptyMaster = nil
+			}
 		}
 	}()
 	if c.calledStart {
 		return errAlreadyCalledStart
 	}
 	c.calledStart = true
+	// Wait for a slot per Shell.MaxRunningCmds. This must happen before locking
+	// cleanupMu, so that Shell.Cleanup can kill running commands, freeing slots.
+	if !c.Detached && !c.internal {
+		c.sh.acquireRun()
+		c.holdsRunSlot = true
+		defer func() {
+			if !c.started {
+				c.releaseRunSlot()
+			}
+		}()
+	}
 	// Protect against Cmd.start() writing to c.c.Process concurrently with
 	// signal-triggered Shell.cleanup() reading from it.
 	c.sh.cleanupMu.Lock()
@@ -599,9 +1820,142 @@ func (c *Cmd) start() (e error) {
 		return errAlreadyCalledCleanup
 	}
 	// Configure the command.
-	c.c.Path = c.Path
-	vars := copyMap(c.Vars)
-	if c.IgnoreParentExit {
+	var err error
+	if c.backend != nil {
+		err = c.useBackend()
+	} else {
+		vars := c.env()
+		// Resolve nice up front, so that a missing nice is not reported as if the
+		// command itself were missing.
+		if c.Nice != 0 && c.runner == nil {
+			if _, err := lookPath(vars, "nice"); err != nil {
+				return fmt.Errorf("%w (required by Cmd.Nice)", err)
+			}
+		}
+		c.c.Env = mapToSlice(vars)
+		c.c.Path, c.c.Args, err = c.argv(vars)
+	}
+	if err != nil {
+		return err
+	}
+	if c.InheritStdin {
+		if c.c.Stdin != nil {
+			return errAlreadySetStdin
+		}
+		c.c.Stdin = os.Stdin
+	}
+	switch {
+	case c.Pty:
+		err = c.makePtyStdio()
+	case c.Detached:
+		err = c.makeDetachedStdoutStderr()
+	default:
+		c.c.Stdout, c.c.Stderr, err = c.makeStdoutStderr()
+	}
+	if err != nil {
+		return err
+	}
+	if c.MergeStderrIntoStdout && !c.Pty {
+		// Use the same writer for both, so that exec.Cmd uses a single fd.
+		c.c.Stderr = c.c.Stdout
+	}
+	c.c.ExtraFiles = c.ExtraFiles
+	if c.Context != nil && !c.Detached {
+		if err := c.Context.Err(); err != nil {
+			return err
+		}
+	}
+	if c.Nice < -20 || c.Nice > 19 {
+		return errInvalidNice
+	}
+	if (c.Nice != 0 || c.Limits != (Limits{})) && c.runner != nil {
+		c.sh.tb.Logf("gosh: Cmd.Nice and Cmd.Limits are not applied to commands started by a Runner: %s\n", c.c.Path)
+	}
+	c.c.SysProcAttr = &syscall.SysProcAttr{}
+	if c.SysProcAttr != nil {
+		*c.c.SysProcAttr = *c.SysProcAttr
+	}
+	// Create a new process group for the child, or a new session (which includes
+	// a new process group) if the child is detached or has a pty. These settings
+	// override any in c.SysProcAttr.
+	attr := c.c.SysProcAttr
+	attr.Setsid = c.Detached || c.Pty
+	attr.Setpgid, attr.Pgid = !attr.Setsid, 0
+	// Make the pty, i.e. the child's stdin, its controlling terminal.
+	attr.Setctty, attr.Ctty = c.Pty, 0
+	if c.Credential != nil {
+		attr.Credential = c.Credential
+	}
+	if !c.IgnoreParentExit && !c.Detached && !c.sh.DisableParentDeathSignal {
+		setParentDeathSignal(attr)
+	}
+	// Start the command. The parent death signal is keyed off the thread that
+	// forks the child rather than the process, so keep this goroutine on a single
+	// thread for the duration of Start.
+	c.startTime = c.sh.clock().Now()
+	runner := c.runner
+	if runner == nil {
+		runner = execRunner{}
+	}
+	runtime.LockOSThread()
+	c.proc, err = runner.Start(c.c)
+	runtime.UnlockOSThread()
+	if err != nil {
+		if cred := attr.Credential; cred != nil && errors.Is(err, syscall.EPERM) {
+			err = fmt.Errorf("insufficient privilege to run as uid %d, gid %d: %w", cred.Uid, cred.Gid, err)
+		}
+		return &StartError{Path: c.c.Path, Err: err}
+	}
+	c.started = true
+	c.sh.updateStats(func(s *ShellStats) { s.CmdsStarted++ })
+	// Rename output files before starting the exit waiter, which reads their
+	// names.
+	renameErr := c.renameOutputFiles()
+	c.startExitWaiter()
+	if c.Context != nil && !c.Detached {
+		c.startContextWatcher()
+	}
+	// Note: If renaming failed, the process keeps running; it will be cleaned up
+	// along with the Shell.
+	return renameErr
+}
+
+// funcInvocation returns the name and args of the registered Func invoked by
+// this command, or "" and nil if this command was not created by Shell.FuncCmd.
+func (c *Cmd) funcInvocation() (string, []interface{}) {
+	s, err := readInvocation(func(key string) string { return c.Vars[key] })
+	if err != nil || s == "" {
+		return "", nil
+	}
+	handle, args, err := decodeInvocation(s)
+	if err != nil {
+		return "", nil
+	}
+	f, err := getFunc(handle)
+	if err != nil {
+		return "", nil
+	}
+	return f.name, args
+}
+
+// env returns the env for the child process.
+func (c *Cmd) env() map[string]string {
+	var vars map[string]string
+	switch {
+	case c.exactEnv:
+		vars = copyMap(c.Vars)
+	case c.ClearEnv:
+		vars = c.sh.varOverrides(c.Vars)
+	default:
+		vars = c.sh.childEnv(c.Vars)
+	}
+	c.setControlVars(vars)
+	return vars
+}
+
+// setControlVars sets (or deletes) the gosh control vars in vars.
+func (c *Cmd) setControlVars(vars map[string]string) {
+	if c.IgnoreParentExit || c.Detached {
 		delete(vars, envWatchParent)
 	} else {
 		vars[envWatchParent] = "1"
@@ -611,39 +1965,164 @@ func (c *Cmd) start() (e error) {
 	} else {
 		vars[envExitAfter] = c.ExitAfter.String()
 	}
-	c.c.Env = mapToSlice(vars)
-	c.c.Args = c.Args
-	var err error
-	if c.c.Stdout, c.c.Stderr, err = c.makeStdoutStderr(); err != nil {
+	if c.sh.VarsTag == "" {
+		delete(vars, envVarsTag)
+	} else {
+		vars[envVarsTag] = c.sh.VarsTag
+	}
+}
+
+// diffEnv returns the differences between the given old and new envs.
+func diffEnv(old, new map[string]string) (added, changed, removed map[string]string) {
+	added, changed, removed = map[string]string{}, map[string]string{}, map[string]string{}
+	for k, v := range new {
+		if oldV, ok := old[k]; !ok {
+			added[k] = v
+		} else if v != oldV {
+			changed[k] = v
+		}
+	}
+	for k, v := range old {
+		if _, ok := new[k]; !ok {
+			removed[k] = v
+		}
+	}
+	return added, changed, removed
+}
+
+// argv returns the path and args for the child process, given its env. If
+// Wrapper is set and Wrapper[0] cannot be resolved, returns an error, along
+// with a path and args that use the unresolved Wrapper[0].
+func (c *Cmd) argv(vars map[string]string) (string, []string, error) {
+	wrapper := c.wrapper()
+	if len(wrapper) == 0 {
+		return c.Path, c.Args, nil
+	}
+	path, err := lookPath(vars, wrapper[0])
+	if err != nil {
+		path = wrapper[0]
+	}
+	return path, append(append([]string{path}, wrapper[1:]...), c.Args...), err
+}
+
+// wrapper returns the command through which to run this Cmd: the launcher, if
+// any, followed by Wrapper.
+func (c *Cmd) wrapper() []string {
+	return append(c.launcher(), c.Wrapper...)
+}
+
+// launcher returns a command that applies Nice and Limits and then runs its
+// args in the same process, or nil if there is nothing to apply. Unlike
+// adjusting the process after Start, this leaves no window in which the child
+// runs without its settings.
+func (c *Cmd) launcher() []string {
+	if c.runner != nil {
+		return nil
+	}
+	var res []string
+	if c.Nice != 0 {
+		res = []string{"nice", "-n", strconv.Itoa(c.Nice)}
+	}
+	if c.Limits == (Limits{}) {
+		return res
+	}
+	var script []string
+	if l := c.Limits.MaxMemoryBytes; l > 0 {
+		script = append(script, fmt.Sprintf("ulimit -v %d", l/1024))
+	}
+	if l := c.Limits.MaxCPUSeconds; l > 0 {
+		// Set the soft limit first, since the hard limit may not be lowered below
+		// it. Leave a one-second gap between the soft limit (SIGXCPU) and the hard
+		// limit (SIGKILL), so that the process may handle SIGXCPU.
+		script = append(script, fmt.Sprintf("ulimit -S -t %d", l), fmt.Sprintf("ulimit -H -t %d", l+1))
+	}
+	script = append(script, `exec "$@"`)
+	return append([]string{"/bin/sh", "-c", strings.Join(script, " && "), "sh"}, res...)
+}
+
+// useBackend configures the child process to run this command via c.backend.
+// Only the vars set by gosh are passed to the backend, since the env of the
+// current process may not make sense wherever the backend runs the command.
+func (c *Cmd) useBackend() error {
+	env := c.sh.varOverrides(c.Vars)
+	if c.exactEnv {
+		env = copyMap(c.Vars)
+	}
+	c.setControlVars(env)
+	args := append(c.wrapper(), c.Args...)
+	d, err := c.backend.Command(CmdDescription{Path: args[0], Args: args, Dir: c.c.Dir, Env: env})
+	if err != nil {
 		return err
 	}
-	c.c.ExtraFiles = c.ExtraFiles
-	// Create a new process group for the child.
-	if c.c.SysProcAttr == nil {
-		c.c.SysProcAttr = &syscall.SysProcAttr{}
-	}
-	c.c.SysProcAttr.Setpgid = true
-	c.c.SysProcAttr.Pgid = 0
-	// Start the command.
-	if err = c.c.Start(); err != nil {
+	if d.Env == nil {
+		d.Env = parentEnv()
+	}
+	if c.c.Path, err = lookPath(d.Env, d.Path); err != nil {
 		return err
 	}
-	c.started = true
-	c.startExitWaiter()
+	c.c.Args, c.c.Dir, c.c.Env = d.Args, d.Dir, mapToSlice(d.Env)
 	return nil
 }
 
+// shellQuote quotes s for use in a Bourne shell command line, if needed.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("_@%+=:,./-", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// isExecProcess returns true iff this command's process was started via
+// os/exec, i.e. it is a real process whose PID can be acted on directly.
+func (c *Cmd) isExecProcess() bool {
+	_, ok := c.proc.(execProcess)
+	return ok
+}
+
+// releaseRunSlot releases the slot acquired per Shell.MaxRunningCmds, if any.
+func (c *Cmd) releaseRunSlot() {
+	if c.holdsRunSlot {
+		c.holdsRunSlot = false
+		c.sh.releaseRun()
+	}
+}
+
 // startExitWaiter spawns a goroutine that calls exec.Cmd.Wait, waiting for the
 // process to exit. Calling exec.Cmd.Wait here rather than in gosh.Cmd.Wait
 // ensures that the child process is reaped once it exits. Note, gosh.Cmd.wait
 // blocks on waitChan.
 func (c *Cmd) startExitWaiter() {
 	go func() {
-		waitErr := c.c.Wait()
+		state, waitErr := c.proc.Wait()
+		c.releaseRunSlot()
+		succeeded := state != nil && state.Success()
+		c.sh.updateStats(func(s *ShellStats) {
+			if succeeded {
+				s.CmdsSucceeded++
+			} else {
+				s.CmdsFailed++
+			}
+		})
+		switch waitErr.(type) {
+		case *exec.ExitError, *fakeExitError:
+			if c.exceededCPULimit(waitErr) {
+				waitErr = ErrCPULimitExceeded
+			} else {
+				waitErr = &ExitError{Path: c.Path, State: state, Err: waitErr}
+			}
+		}
 		c.cond.L.Lock()
+		if c.canceled {
+			waitErr = c.Context.Err()
+		}
 		c.exited = true
+		c.exitTime = c.sh.clock().Now()
+		c.state = state
 		c.cond.Signal()
 		c.cond.L.Unlock()
+		close(c.exitedChan)
 		if err := closeClosers(c.afterWaitClosers); waitErr == nil {
 			waitErr = err
 		}
@@ -653,11 +2132,63 @@ func (c *Cmd) startExitWaiter() {
 				waitErr = err
 			}
 		}
+		c.sh.appendManifest(c)
 		c.waitChan <- waitErr
 		c.cleanupProcessGroup()
 	}()
 }
 
+// startContextWatcher spawns a goroutine that stops the process once c.Context
+// is done, unless the process exits first.
+func (c *Cmd) startContextWatcher() {
+	go func() {
+		select {
+		case <-c.Context.Done():
+		case <-c.exitedChan:
+			return
+		}
+		c.cond.L.Lock()
+		if c.exited {
+			c.cond.L.Unlock()
+			return
+		}
+		c.canceled = true
+		c.cond.L.Unlock()
+		c.cleanupProcessGroup()
+	}()
+}
+
+// exceededCPULimit returns true iff the given wait error indicates that the
+// process was killed for exceeding Limits.MaxCPUSeconds.
+func (c *Cmd) exceededCPULimit(err error) bool {
+	if c.Limits.MaxCPUSeconds == 0 {
+		return false
+	}
+	ee, ok := err.(*exec.ExitError)
+	if !ok {
+		return false
+	}
+	ws, ok := ee.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return false
+	}
+	switch ws.Signal() {
+	case syscall.SIGXCPU:
+		return true
+	case syscall.SIGKILL:
+		// Only attribute SIGKILL to the hard limit if gosh did not send it and the
+		// process has reached the soft limit. (The CPU time reported by wait4 may
+		// fall slightly short of the time at which the kernel enforces the hard
+		// limit.)
+		c.cond.L.Lock()
+		sentKill := c.sentKill
+		c.cond.L.Unlock()
+		cpu := ee.ProcessState.UserTime() + ee.ProcessState.SystemTime()
+		return !sentKill && cpu >= time.Duration(c.Limits.MaxCPUSeconds)*time.Second
+	}
+	return false
+}
+
 func closeClosers(closers []io.Closer) error {
 	var firstErr error
 	for _, closer := range closers {
@@ -673,9 +2204,15 @@ func closeClosers(closers []io.Closer) error {
 func (c *Cmd) awaitVars(keys ...string) (map[string]string, error) {
 	switch {
 	case !c.started:
-		return nil, errDidNotCallStart
+		return nil, ErrNotStarted
 	case c.calledWait:
 		return nil, errAlreadyCalledWait
+	case c.Detached:
+		return nil, errDetachedAwaitVars
+	case c.Pty:
+		return nil, errPtyAwaitVars
+	case c.stderrFile != nil:
+		return nil, errStderrFileVars
 	}
 	wantKeys := map[string]bool{}
 	for _, key := range keys {
@@ -698,20 +2235,131 @@ func (c *Cmd) awaitVars(keys ...string) (map[string]string, error) {
 	}
 	// Return nil error if both conditions triggered simultaneously.
 	if len(res) < len(wantKeys) {
-		return nil, errProcessExited
+		return nil, ErrProcessExited
 	}
 	return res, nil
 }
 
-func (c *Cmd) wait() error {
+func (c *Cmd) awaitAddrs(names ...string) (map[string]string, error) {
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = addrVarForName(name)
+	}
+	vars, err := c.awaitVars(keys...)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string, len(names))
+	for _, name := range names {
+		res[name] = vars[addrVarForName(name)]
+	}
+	return res, nil
+}
+
+func (c *Cmd) awaitHealthy(check func() error, timeout, interval time.Duration) error {
 	switch {
 	case !c.started:
-		return errDidNotCallStart
+		return ErrNotStarted
 	case c.calledWait:
 		return errAlreadyCalledWait
 	}
+	clock := c.sh.clock()
+	deadline := clock.After(timeout)
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-c.exitedChan:
+			return ErrProcessExited
+		case <-deadline:
+			return &TimeoutError{Op: "health check did not pass", Timeout: timeout, Err: err}
+		case <-clock.After(interval):
+		}
+	}
+}
+
+// awaitOutput waits until match returns a non-nil result for a line of the
+// command's stdout or stderr, and returns that result. The description of the
+// awaited lines is used in error messages.
+func (c *Cmd) awaitOutput(match func(line string) []string, desc string, timeout time.Duration) ([]string, error) {
+	switch {
+	case !c.started:
+		return nil, ErrNotStarted
+	case c.calledWait:
+		return nil, errAlreadyCalledWait
+	}
+	found := make(chan []string, 1)
+	stdout := &lineMatcher{match: match, found: found}
+	stderr := &lineMatcher{match: match, found: found}
+	defer stdout.stop()
+	defer stderr.stop()
+	c.stdoutTee.addWithHistory(stdout)
+	c.stderrTee.addWithHistory(stderr)
+	select {
+	case res := <-found:
+		return res, nil
+	case <-c.exitedChan:
+		// All output has been written by the time the process is marked as
+		// exited, so check for a match once more.
+		select {
+		case res := <-found:
+			return res, nil
+		default:
+			return nil, ErrProcessExited
+		}
+	case <-c.sh.clock().After(timeout):
+		return nil, &TimeoutError{Op: fmt.Sprintf("no line %s was written", desc), Timeout: timeout}
+	}
+}
+
+func (c *Cmd) wait() error {
+	if c.skipped {
+		c.calledWait = true
+		return c.skipErr
+	}
+	if !c.started {
+		return ErrNotStarted
+	}
 	c.calledWait = true
-	return <-c.waitChan
+	return c.reap()
+}
+
+// reap waits for the exit waiter to deliver the result of waiting for the
+// process, and returns it. Subsequent calls return the same result.
+func (c *Cmd) reap() error {
+	c.waitOnce.Do(func() {
+		c.waitErr = <-c.waitChan
+		// Once the process has been reaped, AwaitOutput can no longer be called,
+		// so the output retained for it is no longer needed.
+		c.stdoutTee.dropHistory()
+		c.stderrTee.dropHistory()
+		// Likewise, the pty is no longer needed. Note, this does not happen when
+		// the process exits, since output may remain to be read from the pty.
+		if c.ptyMaster != nil {
+			c.ptyMaster.Close()
+		}
+	})
+	return c.waitErr
+}
+
+func (c *Cmd) waitCh() (<-chan error, error) {
+	switch {
+	case !c.started:
+		return nil, ErrNotStarted
+	case c.calledWait:
+		return nil, errAlreadyCalledWait
+	}
+	c.calledWait = true
+	res := make(chan error, 1)
+	go func() {
+		err := c.filterClosedPipeError(c.reap())
+		c.Err = err
+		res <- err
+		close(res)
+	}()
+	return res, nil
 }
 
 // Note: We check for this particular error message to handle the unavoidable
@@ -728,21 +2376,27 @@ const errFinished = "os: process already finished"
 func (c *Cmd) signal(sig os.Signal) error {
 	switch {
 	case !c.started:
-		return errDidNotCallStart
+		return ErrNotStarted
 	case c.calledWait:
 		return errAlreadyCalledWait
 	}
 	if !c.isRunning() {
-		return nil
+		return ErrProcessExited
+	}
+	if sig == os.Kill {
+		c.noteSentKill()
 	}
-	if err := c.c.Process.Signal(sig); err != nil && err.Error() != errFinished {
+	if err := c.proc.Signal(sig); err != nil {
+		if err.Error() == errFinished {
+			return ErrProcessExited
+		}
 		return err
 	}
 	return nil
 }
 
 func (c *Cmd) cleanupProcessGroup() {
-	if !c.started {
+	if !c.started || c.Detached {
 		return
 	}
 	c.cleanupMu.Lock()
@@ -753,33 +2407,120 @@ func (c *Cmd) cleanupProcessGroup() {
 	}
 	c.calledCleanup = true
 
+	if !c.isExecProcess() {
+		// There is no process group to kill; just stop the process itself.
+		c.noteSentKill()
+		c.proc.Signal(os.Kill)
+		return
+	}
 	// Send SIGINT first; then, after a grace period, send SIGKILL to any
 	// process that is still running.
 	if err := syscall.Kill(-c.Pid(), syscall.SIGINT); err == syscall.ESRCH {
 		return
 	}
 	for i := 0; i < 10; i++ {
-		time.Sleep(100 * time.Millisecond)
+		c.sh.clock().Sleep(100 * time.Millisecond)
 		if err := syscall.Kill(-c.Pid(), 0); err == syscall.ESRCH {
 			return
 		}
 	}
+	c.noteSentKill()
 	syscall.Kill(-c.Pid(), syscall.SIGKILL)
 }
 
+// noteSentKill records that gosh is about to send SIGKILL to the process, so
+// that its death is not attributed to Limits.MaxCPUSeconds.
+func (c *Cmd) noteSentKill() {
+	c.cond.L.Lock()
+	c.sentKill = true
+	c.cond.L.Unlock()
+}
+
 func (c *Cmd) terminate(sig os.Signal) error {
-	if err := c.signal(sig); err != nil {
+	if err := c.signal(sig); err != nil && err != ErrProcessExited {
 		return err
 	}
 	if err := c.wait(); err != nil {
 		// Succeed as long as the process exited, regardless of the exit code.
-		if _, ok := err.(*exec.ExitError); !ok {
+		if !isExitError(err) {
 			return err
 		}
 	}
 	return nil
 }
 
+func (c *Cmd) restart() (*Cmd, error) {
+	if c.started && !c.calledWait {
+		c.cleanupProcessGroup()
+		if err := c.wait(); err != nil && !isExitError(err) {
+			return nil, err
+		}
+	}
+	res, err := c.clone()
+	if err != nil {
+		return nil, err
+	}
+	if err := res.start(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *Cmd) then(next *Cmd, onSuccess bool) error {
+	switch {
+	case next.sh != c.sh:
+		return errCmdFromOtherShell
+	case next.calledStart:
+		return errAlreadyCalledStart
+	}
+	status := c.chainStatus()
+	if status != nil && !isExitError(status) && !isStageError(status) {
+		next.skip(&StageError{Cmd: c, Err: status})
+		return status
+	}
+	if (status == nil) == onSuccess {
+		err := next.start()
+		next.Err = err
+		return err
+	}
+	if isExitError(status) {
+		status = &StageError{Cmd: c, Err: status}
+	}
+	next.skip(status)
+	return nil
+}
+
+// chainStatus waits for c, starting it first if needed, and returns its error,
+// which is stored in c.Err. For a command skipped by Then or Else, it returns
+// the outcome of the chain that skipped it.
+func (c *Cmd) chainStatus() error {
+	var err error
+	switch {
+	case c.skipped:
+		err = c.skipErr
+	case !c.calledStart:
+		err = c.run()
+	default:
+		err = c.wait()
+	}
+	err = c.filterClosedPipeError(err)
+	c.Err = err
+	return err
+}
+
+// skip marks c as skipped by Then or Else, with the given chain outcome.
+func (c *Cmd) skip(status error) {
+	c.calledStart = true
+	c.skipped = true
+	c.skipErr = status
+	c.Err = status
+}
+
+func isStageError(err error) bool {
+	_, ok := err.(*StageError)
+	return ok
+}
+
 func (c *Cmd) run() error {
 	if err := c.start(); err != nil {
 		return err
@@ -791,8 +2532,8 @@ func (c *Cmd) stdout() (string, error) {
 	if c.calledStart {
 		return "", errAlreadyCalledStart
 	}
-	var stdout bytes.Buffer
-	c.stdoutWriters = append(c.stdoutWriters, &stdout)
+	stdout := c.stdoutCap()
+	stdout.keepAll = true
 	err := c.run()
 	return stdout.String(), err
 }
@@ -801,13 +2542,24 @@ func (c *Cmd) stdoutStderr() (string, string, error) {
 	if c.calledStart {
 		return "", "", errAlreadyCalledStart
 	}
-	var stdout, stderr bytes.Buffer
-	c.stdoutWriters = append(c.stdoutWriters, &stdout)
-	c.stderrWriters = append(c.stderrWriters, &stderr)
+	stdout, stderr := c.stdoutCap(), c.stderrCap()
+	stdout.keepAll, stderr.keepAll = true, true
 	err := c.run()
 	return stdout.String(), stderr.String(), err
 }
 
+func (c *Cmd) result() CmdResult {
+	stdout, stderr, err := c.stdoutStderr()
+	res := CmdResult{Stdout: stdout, Stderr: stderr, ExitCode: c.ExitCode(), Err: err}
+	res.Signal, _ = c.Signaled()
+	c.cond.L.Lock()
+	if c.exited {
+		res.Duration = c.exitTime.Sub(c.startTime)
+	}
+	c.cond.L.Unlock()
+	return res
+}
+
 func (c *Cmd) combinedOutput() (string, error) {
 	if c.calledStart {
 		return "", errAlreadyCalledStart
@@ -0,0 +1,59 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+// CmdTemplate is a template for creating Cmds that share a program, base
+// arguments, and env vars, e.g. a server binary that is run with many flag
+// combinations. A CmdTemplate is immutable once created.
+type CmdTemplate struct {
+	sh   *Shell
+	path string
+	args []string
+	vars map[string]string
+}
+
+// CmdTemplate returns a CmdTemplate for invocations of the named program, with
+// the given env vars and base arguments. The vars are applied on top of
+// Shell.Vars. The name is resolved immediately, as in Shell.Cmd.
+func (sh *Shell) CmdTemplate(vars map[string]string, name string, args ...string) *CmdTemplate {
+	sh.Ok()
+	res, err := sh.cmdTemplate(vars, name, args...)
+	sh.handleError(err)
+	return res
+}
+
+// Instantiate returns a new Cmd for an invocation of this template's program,
+// with the given arguments appended to the template's base arguments.
+func (t *CmdTemplate) Instantiate(extraArgs ...string) *Cmd {
+	t.sh.Ok()
+	res, err := t.instantiate(extraArgs...)
+	t.sh.handleError(err)
+	return res
+}
+
+////////////////////////////////////////
+// Internals
+
+func (sh *Shell) cmdTemplate(vars map[string]string, name string, args ...string) (*CmdTemplate, error) {
+	path := name
+	if sh.Backend == nil {
+		var err error
+		if path, err = lookPath(sh.childEnv(mergeMaps(sh.Vars, vars)), name); err != nil {
+			return nil, err
+		}
+	}
+	return &CmdTemplate{
+		sh:   sh,
+		path: path,
+		args: append([]string(nil), args...),
+		vars: copyMap(vars),
+	}, nil
+}
+
+func (t *CmdTemplate) instantiate(extraArgs ...string) (*Cmd, error) {
+	args := make([]string, 0, len(t.args)+len(extraArgs)+len(t.sh.Args))
+	args = append(append(append(args, t.args...), extraArgs...), t.sh.Args...)
+	return t.sh.cmd(copyMap(t.vars), t.path, args...)
+}
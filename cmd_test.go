@@ -0,0 +1,139 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// BenchmarkRecvWriter writes a large stream that contains no gosh vars to a
+// recvWriter.
+func BenchmarkRecvWriter(b *testing.B) {
+	line := bytes.Repeat([]byte("some <output> line\n"), 1<<10)
+	b.SetBytes(int64(len(line)))
+	w := newRecvWriter(&Cmd{sh: &Shell{}, cond: sync.NewCond(&sync.Mutex{})})
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Write(line); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestTimestampWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := newTimestampWriter(&buf, realClock{})
+	for _, s := range []string{"foo\nba", "r\n", "\nbaz\nqux"} {
+		if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+			t.Errorf("write got (%v, %v), want (%v, <nil>)", n, err, len(s))
+		}
+	}
+	lines := strings.Split(buf.String(), "\n")
+	want := []string{"foo", "bar", "", "baz", "qux"}
+	if len(lines) != len(want) {
+		t.Fatalf("got %q, want %d lines", buf.String(), len(want))
+	}
+	for i, line := range lines {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 || parts[1] != want[i] {
+			t.Errorf("got line %q, want timestamp followed by %q", line, want[i])
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339Nano, parts[0]); err != nil {
+			t.Errorf("got line %q, want timestamp: %v", line, err)
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestSendVars(t *testing.T) {
+	c := &Cmd{sh: &Shell{}, cond: sync.NewCond(&sync.Mutex{})}
+	if err := sendVars(newRecvWriter(c), map[string]string{"a": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.recvVars["a"], "1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Write errors are returned rather than dropped.
+	if err := sendVars(failingWriter{}, map[string]string{"a": "1"}); err != io.ErrClosedPipe {
+		t.Errorf("got %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestLineMatcher(t *testing.T) {
+	found := make(chan []string, 1)
+	maxLen := 0
+	w := &lineMatcher{match: func(line string) []string {
+		if len(line) > maxLen {
+			maxLen = len(line)
+		}
+		if strings.HasPrefix(line, "ready") {
+			return []string{line}
+		}
+		return nil
+	}, found: found}
+	// Partial lines are not matched, and overlong lines are truncated.
+	for _, s := range []string{"foo\n", strings.Repeat("x", maxLineSize+10), "\nbar\nrea"} {
+		if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("write got (%v, %v), want (%v, <nil>)", n, err, len(s))
+		}
+	}
+	select {
+	case <-found:
+		t.Fatal("unexpected match")
+	default:
+	}
+	if maxLen != maxLineSize {
+		t.Errorf("got max line length %v, want %v", maxLen, maxLineSize)
+	}
+	// Lines may span writes, and only the first match is reported.
+	if _, err := w.Write([]byte("dy\nready again\n")); err != errStopMatching {
+		t.Errorf("got %v, want %v", err, errStopMatching)
+	}
+	if got, want := <-found, []string{"ready"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestTeeWriterHistory(t *testing.T) {
+	const capacity = 1 << 12
+	w := &teeWriter{}
+	// No output is retained until a capacity is set.
+	w.Write([]byte("zeroth\n"))
+	w.setHistoryCapacity(capacity)
+	w.Write([]byte("first\n"))
+	var buf bytes.Buffer
+	w.addWithHistory(&buf)
+	w.Write([]byte("second\n"))
+	if got, want := buf.String(), "first\nsecond\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Old output is discarded a line at a time.
+	line := strings.Repeat("x", capacity/4) + "\n"
+	for i := 0; i < 12; i++ {
+		w.Write([]byte(line))
+	}
+	if n := len(w.history); n < capacity || n > 2*capacity+len(line) {
+		t.Errorf("got %v bytes of history, want [%v, %v]", n, capacity, 2*capacity+len(line))
+	}
+	if !bytes.HasPrefix(w.history, []byte(line)) {
+		t.Error("history does not start at a line")
+	}
+	// Once dropped, no more output is retained.
+	w.dropHistory()
+	w.Write([]byte("third\n"))
+	if len(w.history) != 0 {
+		t.Errorf("got %q, want no history", w.history)
+	}
+}
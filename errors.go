@@ -0,0 +1,130 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The errors below, along with ErrProcessExited and ErrCPULimitExceeded, let
+// callers distinguish common failures, e.g. in Shell.Err or Cmd.Err with
+// ContinueOnError set, using errors.Is and errors.As.
+
+var (
+	// ErrNotFound is wrapped by the error returned when an executable cannot be
+	// located.
+	ErrNotFound = errors.New("gosh: executable not found")
+	// ErrNotStarted is returned by Cmd methods that must not be called before
+	// Start.
+	ErrNotStarted = errors.New("gosh: did not call Cmd.Start")
+	// ErrTimeout matches every TimeoutError, per errors.Is.
+	ErrTimeout = errors.New("gosh: timed out")
+)
+
+// StartError is returned when a command's process could not be started, e.g.
+// because its executable could not be run.
+type StartError struct {
+	// Path is the path of the executable.
+	Path string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *StartError) Error() string {
+	return fmt.Sprintf("gosh: failed to start %s: %v", e.Path, e.Err)
+}
+
+func (e *StartError) Unwrap() error {
+	return e.Err
+}
+
+// ExitError is returned when a command's process exits with a non-zero code or
+// is terminated by a signal. Its message is that of the underlying error, e.g.
+// "exit status 1".
+type ExitError struct {
+	// Path is the path of the command.
+	Path string
+	// State describes the exited process.
+	State ProcessState
+	// Err is the underlying error, e.g. the *exec.ExitError returned by
+	// exec.Cmd.Wait. Cmd.Err and Shell.Err hold the *ExitError itself, so use
+	// errors.As to get at Err.
+	Err error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the process's exit code, or -1 if it was terminated by a
+// signal.
+func (e *ExitError) ExitCode() int {
+	return e.State.ExitCode()
+}
+
+// TimeoutError is returned when an operation with a timeout, e.g. AwaitOutput
+// or AwaitHealthy, does not complete in time.
+type TimeoutError struct {
+	// Op describes what did not happen in time, e.g. "health check did not pass".
+	Op string
+	// Timeout is the timeout that elapsed.
+	Timeout time.Duration
+	// Err, if non-nil, is the last error seen before the timeout elapsed.
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("gosh: %s within %v", e.Op, e.Timeout)
+	}
+	return fmt.Sprintf("gosh: %s within %v: %v", e.Op, e.Timeout, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrTimeout.
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// ProtocolError is returned when a child violates the gosh control protocol,
+// e.g. by sending vars that cannot be decoded.
+type ProtocolError struct {
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("gosh: invalid vars sent by child: %v", e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// StageError is returned when waiting for a command that was skipped by
+// Cmd.Then or Cmd.Else because an earlier command in the chain failed.
+type StageError struct {
+	// Cmd is the command that failed.
+	Cmd *Cmd
+	// Err is the error with which it failed.
+	Err error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("gosh: skipped because an earlier command failed: %s: %v", e.Cmd.String(), e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
@@ -21,7 +21,7 @@ func ExampleCmd() {
 	binPath := gosh.BuildGoPkg(sh, binDir, "github.com/asadovsky/gosh/internal/gosh_example_server")
 	c := sh.Cmd(binPath)
 	c.Start()
-	addr := c.AwaitVars("addr")["addr"]
+	addr := c.AwaitAddr()
 	fmt.Println(addr)
 
 	// Run client.
@@ -43,7 +43,7 @@ func ExampleFuncCmd() {
 	// Start server.
 	c := sh.FuncCmd(serveFunc)
 	c.Start()
-	addr := c.AwaitVars("addr")["addr"]
+	addr := c.AwaitAddr()
 	fmt.Println(addr)
 
 	// Run client.
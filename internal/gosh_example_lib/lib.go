@@ -52,10 +52,7 @@ func Serve() {
 	if err != nil {
 		panic(err)
 	}
-	go func() {
-		time.Sleep(100 * time.Millisecond)
-		gosh.SendVars(map[string]string{"addr": ln.Addr().String()})
-	}()
+	gosh.AnnounceAddr(ln)
 	if err = srv.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)}); err != nil {
 		panic(err)
 	}
@@ -0,0 +1,14 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+// TestHelloWorld exists so that tests can build this package's test binary.
+func TestHelloWorld(t *testing.T) {
+	t.Log("Hello, test!")
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"encoding/json"
+	"syscall"
+	"time"
+)
+
+// ManifestEntry describes a completed command. If Shell.ManifestPath is set,
+// one JSON-encoded ManifestEntry is appended to it per line as each command
+// exits.
+type ManifestEntry struct {
+	// Path is the resolved path of the executable, or of Cmd.Wrapper[0] if set.
+	Path string
+	// Args is the full argv, including Cmd.Wrapper if set.
+	Args []string
+	// Dir is the working directory, or "" for the parent's working directory.
+	Dir string
+	// Env is the full env, including gosh control vars.
+	Env map[string]string
+	// FuncName and FuncArgs describe the registered Func invoked by the
+	// command, if it was created by Shell.FuncCmd.
+	FuncName string        `json:",omitempty"`
+	FuncArgs []interface{} `json:",omitempty"`
+	// ExitCode is the exit code, or -1 if the process was terminated by a
+	// signal, in which case Signal names the signal.
+	ExitCode int
+	Signal   string `json:",omitempty"`
+	// Start is the time at which the command was started, and Duration is how
+	// long it ran.
+	Start    time.Time
+	Duration time.Duration
+	// OutputFiles lists the files to which stdout and stderr were written, if
+	// OutputDir was set.
+	OutputFiles []string `json:",omitempty"`
+}
+
+// manifestEntry returns a ManifestEntry for the given command, which must have
+// exited.
+func (c *Cmd) manifestEntry(end time.Time) ManifestEntry {
+	name, args := c.funcInvocation()
+	res := ManifestEntry{
+		Path:        c.c.Path,
+		Args:        c.c.Args,
+		Dir:         c.c.Dir,
+		Env:         sliceToMap(c.c.Env),
+		FuncName:    name,
+		FuncArgs:    args,
+		ExitCode:    c.state.ExitCode(),
+		Start:       c.startTime,
+		Duration:    end.Sub(c.startTime),
+		OutputFiles: c.outputFiles,
+	}
+	if ws, ok := c.state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		res.Signal = ws.Signal().String()
+	}
+	return res
+}
+
+// appendManifest appends an entry for the given command to ManifestPath, if
+// set. Errors are logged rather than reported, since commands exit
+// asynchronously.
+func (sh *Shell) appendManifest(c *Cmd) {
+	if sh.ManifestPath == "" {
+		return
+	}
+	data, err := json.Marshal(c.manifestEntry(sh.clock().Now()))
+	if err == nil {
+		sh.manifestMu.Lock()
+		err = appendFile(sh.ManifestPath, append(data, '\n'), 0600)
+		sh.manifestMu.Unlock()
+	}
+	if err != nil {
+		sh.tb.Logf("gosh: failed to append to manifest %q: %v\n", sh.ManifestPath, err)
+	}
+}
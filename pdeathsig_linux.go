@@ -0,0 +1,18 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"syscall"
+)
+
+// setParentDeathSignal configures attr so that the kernel sends SIGKILL to the
+// child when the thread that started it exits, unless attr already specifies a
+// parent death signal.
+func setParentDeathSignal(attr *syscall.SysProcAttr) {
+	if attr.Pdeathsig == 0 {
+		attr.Pdeathsig = syscall.SIGKILL
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package gosh
+
+import (
+	"syscall"
+)
+
+// setParentDeathSignal is a no-op; parent death signals are only supported on
+// Linux.
+func setParentDeathSignal(attr *syscall.SysProcAttr) {}
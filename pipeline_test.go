@@ -228,3 +228,22 @@ func TestPipelineTerminate(t *testing.T) {
 	p.Run()
 	setsErr(t, sh, func() { p.Terminate(os.Interrupt) })
 }
+
+// Tests that a command that exits with a non-zero exit code after writing to a
+// closed pipe does not fail the pipeline, unless IgnoreClosedPipeError is
+// reset.
+func TestPipelineClosedPipeExitError(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	p := gosh.NewPipeline(sh.FuncCmd(writeLoopExitFunc), sh.FuncCmd(readFunc))
+	p.Run()
+	ok(t, p.Cmds()[0].Err)
+	ok(t, p.Cmds()[1].Err)
+
+	p = gosh.NewPipeline(sh.FuncCmd(writeLoopExitFunc), sh.FuncCmd(readFunc))
+	p.Cmds()[0].IgnoreClosedPipeError = false
+	setsErr(t, sh, p.Run)
+	nok(t, p.Cmds()[0].Err)
+	ok(t, p.Cmds()[1].Err)
+}
@@ -0,0 +1,30 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package gosh
+
+import (
+	"errors"
+	"os"
+)
+
+var errPtyNotSupported = errors.New("gosh: Cmd.Pty is not supported on this platform")
+
+// openPty allocates a pseudo-terminal, returning its master and slave sides.
+func openPty() (*os.File, *os.File, error) {
+	return nil, nil, errPtyNotSupported
+}
+
+// getPtySize returns the window size of the given terminal.
+func getPtySize(f *os.File) (uint16, uint16, error) {
+	return 0, 0, errPtyNotSupported
+}
+
+// setPtySize sets the window size of the given terminal.
+func setPtySize(f *os.File, rows, cols uint16) error {
+	return errPtyNotSupported
+}
@@ -8,6 +8,8 @@ package gosh
 
 import (
 	"bytes"
+	"context"
+	"encoding"
 	"encoding/base64"
 	"encoding/gob"
 	"errors"
@@ -20,37 +22,146 @@ import (
 // Func is a registered, callable function.
 type Func struct {
 	handle string
+	name   string
 	value  reflect.Value
+	// takesContext is true if the function's first parameter is a
+	// context.Context, which is supplied by the child rather than passed as an
+	// argument.
+	takesContext bool
+	// hasResult is true if the function returns a result (other than an error),
+	// which is sent back to the parent by Shell.CallInChild.
+	hasResult bool
 }
 
 var (
-	errorType = reflect.TypeOf((*error)(nil)).Elem()
-	funcsMu   = sync.RWMutex{} // protects funcs
-	funcs     = map[string]*Func{}
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	funcsMu     = sync.RWMutex{} // protects funcs
+	funcs       = map[string]*Func{}
 )
 
 // RegisterFunc registers the given function with the given name. 'fi' must be a
-// function that accepts gob-encodable arguments and returns an error or
-// nothing.
+// function that accepts gob-encodable arguments and returns nothing, an error,
+// a gob-encodable result, or a result and an error. Results are only used by
+// Shell.CallInChild, to which the child sends them via SendVars; their size is
+// not limited, but they are held in memory on both sides. If the function's
+// first parameter is a context.Context, that parameter is not passed by
+// Shell.FuncCmd; instead, the child passes a context that is canceled when the
+// parent process exits, when Cmd.ExitAfter elapses, or when the child receives
+// SIGINT or SIGTERM.
 func RegisterFunc(name string, fi interface{}) *Func {
+	_, file, line, _ := runtime.Caller(1)
+	f, err := newFunc(fmt.Sprintf("%s:%d", file, line), name, fi)
+	if err != nil {
+		panic(err)
+	}
+	return registerFunc(f)
+}
+
+// RegisterFuncAuto is like RegisterFunc, but derives the name from the
+// function's package-qualified name, e.g. "github.com/foo/bar.Baz", as reported
+// by runtime.FuncForPC. The derived name is the same in the parent and child
+// processes, since they run the same binary.
+func RegisterFuncAuto(fi interface{}) *Func {
+	_, file, line, _ := runtime.Caller(1)
+	name := ""
+	if v := reflect.ValueOf(fi); fi != nil && v.Kind() == reflect.Func {
+		if rf := runtime.FuncForPC(v.Pointer()); rf != nil {
+			name = rf.Name()
+		}
+	}
+	f, err := newFunc(fmt.Sprintf("%s:%d", file, line), name, fi)
+	if err != nil {
+		panic(err)
+	}
+	return registerFunc(f)
+}
+
+// registerFunc adds the given Func to the registry, panicking if its handle is
+// already registered.
+func registerFunc(f *Func) *Func {
 	funcsMu.Lock()
 	defer funcsMu.Unlock()
+	if _, ok := funcs[f.handle]; ok {
+		panic(fmt.Errorf("gosh: %q is already registered", f.handle))
+	}
+	funcs[f.handle] = f
+	f.registerGobTypes()
+	return f
+}
+
+// RegisterFuncs registers the given functions, keyed by name, and returns the
+// registered Funcs, keyed by the same names. Each function must satisfy the
+// requirements of RegisterFunc. Unlike RegisterFunc, names must be unique
+// across the registry, not just per call site. If any function is invalid or
+// its name is already registered, RegisterFuncs panics without registering any
+// of them.
+func RegisterFuncs(m map[string]interface{}) map[string]*Func {
 	_, file, line, _ := runtime.Caller(1)
-	handle := fmt.Sprintf("%s:%d:%s", file, line, name)
-	if _, ok := funcs[handle]; ok {
-		panic(fmt.Errorf("gosh: %q is already registered", handle))
+	res := make(map[string]*Func, len(m))
+	for name, fi := range m {
+		f, err := newFunc(fmt.Sprintf("%s:%d", file, line), name, fi)
+		if err != nil {
+			panic(err)
+		}
+		res[name] = f
 	}
+	funcsMu.Lock()
+	defer funcsMu.Unlock()
+	for _, f := range funcs {
+		if _, ok := res[f.name]; ok {
+			panic(fmt.Errorf("gosh: %q is already registered as %q", f.name, f.handle))
+		}
+	}
+	for _, f := range res {
+		funcs[f.handle] = f
+		f.registerGobTypes()
+	}
+	return res
+}
+
+// newFunc checks that the given function can be registered, and returns a Func
+// for it. The handle is formed from the given call site and name.
+func newFunc(site, name string, fi interface{}) (*Func, error) {
 	v := reflect.ValueOf(fi)
+	if fi == nil || v.Kind() != reflect.Func {
+		return nil, fmt.Errorf("gosh: %q is not a function: %v", name, v.Kind())
+	}
 	t := v.Type()
-	if t.Kind() != reflect.Func {
-		panic(fmt.Errorf("gosh: %q is not a function: %v", name, t.Kind()))
+	switch {
+	case t.NumOut() > 2,
+		t.NumOut() == 2 && (t.Out(0) == errorType || t.Out(1) != errorType):
+		return nil, fmt.Errorf("gosh: %q must return nothing, an error, a result, or a result and an error: %v", name, t)
 	}
-	if t.NumOut() > 1 || t.NumOut() == 1 && t.Out(0) != errorType {
-		panic(fmt.Errorf("gosh: %q must return an error or nothing: %v", name, t))
+	f := &Func{handle: site + ":" + name, name: name, value: v}
+	f.takesContext = t.NumIn() > 0 && t.In(0) == contextType
+	f.hasResult = t.NumOut() > 0 && t.Out(0) != errorType
+	if f.hasResult {
+		if err := checkGobEncodable(t.Out(0), map[reflect.Type]bool{}); err != nil {
+			return nil, fmt.Errorf("gosh: %q result of type %v cannot be gob-encoded: %v", name, t.Out(0), err)
+		}
+	}
+	for i := f.numContext(); i < t.NumIn(); i++ {
+		if err := checkGobEncodable(t.In(i), map[reflect.Type]bool{}); err != nil {
+			return nil, fmt.Errorf("gosh: %q arg %d of type %v cannot be gob-encoded: %v", name, i, t.In(i), err)
+		}
+	}
+	return f, nil
+}
+
+// registerGobTypes registers the function's result and arg types with gob. It
+// is called once the function is registered, so that rejected functions have no
+// global side effects.
+func (f *Func) registerGobTypes() {
+	t := f.value.Type()
+	// Register the result type with gob, since results are encoded as
+	// interface{} values.
+	if f.hasResult && t.Out(0).Kind() != reflect.Interface {
+		gob.Register(reflect.Zero(t.Out(0)).Interface())
 	}
 	// Register the function's args with gob. Needed because Shell.Func takes
 	// interface{} arguments.
-	for i := 0; i < t.NumIn(); i++ {
+	for i := f.numContext(); i < t.NumIn(); i++ {
 		// Note: Users are responsible for registering any concrete types stored
 		// inside interface{} arguments.
 		if t.In(i).Kind() == reflect.Interface {
@@ -58,9 +169,65 @@ func RegisterFunc(name string, fi interface{}) *Func {
 		}
 		gob.Register(reflect.Zero(t.In(i)).Interface())
 	}
-	f := &Func{handle: handle, value: v}
-	funcs[handle] = f
-	return f
+}
+
+// numContext returns 1 if the function takes a leading context.Context, and 0
+// otherwise.
+func (f *Func) numContext() int {
+	if f.takesContext {
+		return 1
+	}
+	return 0
+}
+
+var (
+	gobEncoderType      = reflect.TypeOf((*gob.GobEncoder)(nil)).Elem()
+	binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+)
+
+// checkGobEncodable returns an error if values of type t can never be
+// gob-encoded, e.g. funcs, chans, and structs without exported fields. Types in
+// seen are assumed to be encodable, to handle recursive types.
+func checkGobEncodable(t reflect.Type, seen map[reflect.Type]bool) error {
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+	if t.Implements(gobEncoderType) || t.Implements(binaryMarshalerType) ||
+		reflect.PtrTo(t).Implements(gobEncoderType) || reflect.PtrTo(t).Implements(binaryMarshalerType) {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return fmt.Errorf("%v values are not supported", t.Kind())
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return checkGobEncodable(t.Elem(), seen)
+	case reflect.Map:
+		if err := checkGobEncodable(t.Key(), seen); err != nil {
+			return err
+		}
+		return checkGobEncodable(t.Elem(), seen)
+	case reflect.Struct:
+		// Gob ignores unexported fields, as well as fields of func or chan type.
+		exported := false
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			if k := f.Type.Kind(); k == reflect.Func || k == reflect.Chan {
+				continue
+			}
+			if err := checkGobEncodable(f.Type, seen); err != nil {
+				return fmt.Errorf("field %s: %v", f.Name, err)
+			}
+			exported = true
+		}
+		if !exported {
+			return fmt.Errorf("type %v has no exported fields", t)
+		}
+	}
+	return nil
 }
 
 // getFunc returns the referenced function.
@@ -74,19 +241,24 @@ func getFunc(handle string) (*Func, error) {
 	return f, nil
 }
 
-// callFunc calls the referenced function, which must have been registered.
-func callFunc(handle string, args ...interface{}) error {
+// callFunc calls the referenced function, which must have been registered, and
+// returns its result (or nil if it has none) and error.
+func callFunc(handle string, args ...interface{}) (interface{}, error) {
 	f, err := getFunc(handle)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	return f.call(args...)
 }
 
-// call calls this Func with the given input arguments.
-func (f *Func) call(args ...interface{}) error {
+// call calls this Func with the given input arguments, and returns its result
+// (or nil if it has none) and error.
+func (f *Func) call(args ...interface{}) (interface{}, error) {
 	t := f.value.Type()
 	in := []reflect.Value{}
+	if f.takesContext {
+		in = append(in, reflect.ValueOf(childContext()))
+	}
 	for i, arg := range args {
 		var av reflect.Value
 		if arg != nil {
@@ -94,15 +266,19 @@ func (f *Func) call(args ...interface{}) error {
 		} else {
 			// User passed nil; construct the zero value for this argument based on
 			// the function signature.
-			av = reflect.Zero(argType(t, i))
+			av = reflect.Zero(argType(t, i+f.numContext()))
 		}
 		in = append(in, av)
 	}
 	out := f.value.Call(in)
-	if t.NumOut() == 1 && !out[0].IsNil() {
-		return out[0].Interface().(error)
+	var res interface{}
+	if f.hasResult {
+		res, out = out[0].Interface(), out[1:]
 	}
-	return nil
+	if len(out) == 1 && !out[0].IsNil() {
+		return res, out[0].Interface().(error)
+	}
+	return res, nil
 }
 
 // argType returns the type of the nth argument to a function of type t.
@@ -121,7 +297,7 @@ func checkCall(handle string, args ...interface{}) error {
 		return err
 	}
 	t := f.value.Type()
-	n := t.NumIn()
+	n := t.NumIn() - f.numContext()
 	if t.IsVariadic() {
 		n--
 	}
@@ -135,7 +311,7 @@ func checkCall(handle string, args ...interface{}) error {
 		if arg == nil {
 			continue
 		}
-		if at, et := reflect.ValueOf(arg).Type(), argType(t, i); !at.AssignableTo(et) {
+		if at, et := reflect.ValueOf(arg).Type(), argType(t, i+f.numContext()); !at.AssignableTo(et) {
 			return fmt.Errorf("gosh: cannot use %s as type %s", at, et)
 		}
 	}
@@ -177,3 +353,34 @@ func decodeInvocation(s string) (handle string, args []interface{}, err error) {
 	}
 	return inv.Handle, inv.Args, nil
 }
+
+////////////////////////////////////////
+// result
+
+type result struct {
+	Result interface{}
+}
+
+// encodeResult encodes the result of a function call.
+func encodeResult(res interface{}) (string, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(result{Result: res}); err != nil {
+		return "", fmt.Errorf("gosh: failed to encode result: %v", err)
+	}
+	// Base64-encode the gob-encoded bytes so that the result can be sent as a
+	// var.
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodeResult decodes the result of a function call.
+func decodeResult(s string) (interface{}, error) {
+	var res result
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewReader(b)).Decode(&res)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gosh: failed to decode result: %v", err)
+	}
+	return res.Result, nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Runner starts the child processes of a Shell's commands. By default, gosh
+// starts them via os/exec; set Shell.Runner to use another Runner, e.g. a
+// FakeRunner to test orchestration logic without spawning real processes.
+type Runner interface {
+	// Start starts the process described by cmd, which is fully configured,
+	// including Path, Args, Env, Dir, Stdin, Stdout, Stderr, ExtraFiles, and
+	// SysProcAttr. Like exec.Cmd.Start, it must not wait for the process to exit.
+	Start(cmd *exec.Cmd) (Process, error)
+}
+
+// Process is a child process started by a Runner.
+type Process interface {
+	// Pid returns the process's PID.
+	Pid() int
+	// Signal sends a signal to the process. If the process has exited, it
+	// returns an error whose message is "os: process already finished", like
+	// os.Process.Signal.
+	Signal(sig os.Signal) error
+	// Wait waits for the process to exit and for its output to be written, then
+	// returns its state. Like exec.Cmd.Wait, it returns an error if the process
+	// did not exit successfully or its I/O failed.
+	Wait() (ProcessState, error)
+}
+
+// ProcessState describes an exited process. It is implemented by
+// os.ProcessState.
+type ProcessState interface {
+	// ExitCode returns the exit code, or -1 if the process was terminated by a
+	// signal.
+	ExitCode() int
+	// Success returns true iff the process exited with code zero.
+	Success() bool
+	// Sys returns system-dependent exit information, i.e. a syscall.WaitStatus
+	// on Unix.
+	Sys() interface{}
+}
+
+// FakeResult is the canned result of a command run by a FakeRunner.
+type FakeResult struct {
+	// Stdout and Stderr are written to the command's stdout and stderr when it
+	// starts.
+	Stdout string
+	Stderr string
+	// ExitCode is the command's exit code.
+	ExitCode int
+	// Running, if true, makes the command keep running until it is sent a
+	// signal, rather than exiting as soon as it starts.
+	Running bool
+}
+
+// FakeRunner is a Runner that does not spawn real processes. Each command
+// writes its canned output and exits, per its FakeResult. Command names are
+// still resolved by Shell.Cmd, so they must exist; FuncCmd commands do not run
+// their Func.
+//
+// Cmd.Nice and Cmd.Limits are not applied to commands started by a FakeRunner
+// (a warning is logged), and process groups are not killed.
+type FakeRunner struct {
+	// Results maps a command line, i.e. the base name of the command's path
+	// followed by its arguments, separated by spaces (e.g. "git status -s"), to
+	// its result. Commands not found in Results get Default.
+	Results map[string]FakeResult
+	// Default is the result of commands not found in Results.
+	Default  FakeResult
+	mu       sync.Mutex // protects the fields below
+	cmdLines []string
+	nextPid  int
+}
+
+var _ Runner = (*FakeRunner)(nil)
+
+// NewFakeRunner returns a new FakeRunner whose commands succeed with no output,
+// unless configured otherwise via Results or Default.
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{Results: map[string]FakeResult{}}
+}
+
+// Start implements the Runner.Start method.
+func (r *FakeRunner) Start(cmd *exec.Cmd) (Process, error) {
+	args := append([]string{filepath.Base(cmd.Path)}, cmd.Args[1:]...)
+	cmdLine := strings.Join(args, " ")
+	r.mu.Lock()
+	res, ok := r.Results[cmdLine]
+	if !ok {
+		res = r.Default
+	}
+	r.cmdLines = append(r.cmdLines, cmdLine)
+	// Use PIDs beyond the maximum allowed by Linux, so that they can't refer to
+	// real processes.
+	r.nextPid++
+	pid := 1<<22 + r.nextPid
+	r.mu.Unlock()
+	// Write the output before returning, since gosh may close the command's
+	// files once it has started.
+	for _, out := range []struct {
+		w io.Writer
+		s string
+	}{{cmd.Stdout, res.Stdout}, {cmd.Stderr, res.Stderr}} {
+		if out.w != nil && out.s != "" {
+			if _, err := io.WriteString(out.w, out.s); err != nil {
+				return nil, err
+			}
+		}
+	}
+	p := &fakeProcess{pid: pid, exitedChan: make(chan struct{})}
+	if !res.Running {
+		p.exit(fakeProcessState(syscall.WaitStatus(res.ExitCode << 8)))
+	}
+	return p, nil
+}
+
+// CmdLines returns the command lines of all commands started by this
+// FakeRunner, in order, in the format used by Results.
+func (r *FakeRunner) CmdLines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.cmdLines...)
+}
+
+////////////////////////////////////////
+// Internals
+
+// execRunner is the default Runner, which starts processes via os/exec.
+type execRunner struct{}
+
+func (execRunner) Start(cmd *exec.Cmd) (Process, error) {
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return execProcess{cmd}, nil
+}
+
+type execProcess struct {
+	cmd *exec.Cmd
+}
+
+func (p execProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+func (p execProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p execProcess) Wait() (ProcessState, error) {
+	err := p.cmd.Wait()
+	if p.cmd.ProcessState == nil {
+		return nil, err
+	}
+	return p.cmd.ProcessState, err
+}
+
+// fakeProcessState implements ProcessState for processes started by a
+// FakeRunner.
+type fakeProcessState syscall.WaitStatus
+
+func (s fakeProcessState) ExitCode() int {
+	return syscall.WaitStatus(s).ExitStatus()
+}
+
+func (s fakeProcessState) Success() bool {
+	return s.ExitCode() == 0
+}
+
+func (s fakeProcessState) Sys() interface{} {
+	return syscall.WaitStatus(s)
+}
+
+// fakeExitError is returned by the Wait method of a fakeProcess that did not
+// exit successfully, in place of an exec.ExitError.
+type fakeExitError struct {
+	state fakeProcessState
+}
+
+func (e *fakeExitError) Error() string {
+	if ws := syscall.WaitStatus(e.state); ws.Signaled() {
+		return "signal: " + ws.Signal().String()
+	}
+	return "exit status " + strconv.Itoa(e.state.ExitCode())
+}
+
+type fakeProcess struct {
+	pid        int
+	mu         sync.Mutex // protects state
+	state      fakeProcessState
+	exitedChan chan struct{} // closed when the process exits
+}
+
+// exit makes the process exit with the given state, and returns true, if it
+// hasn't already exited. Otherwise, it returns false.
+func (p *fakeProcess) exit(state fakeProcessState) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.exitedChan:
+		return false
+	default:
+	}
+	p.state = state
+	close(p.exitedChan)
+	return true
+}
+
+func (p *fakeProcess) Pid() int {
+	return p.pid
+}
+
+func (p *fakeProcess) Signal(sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return errors.New("gosh: unsupported signal type")
+	}
+	if s == 0 {
+		select {
+		case <-p.exitedChan:
+			return errors.New(errFinished)
+		default:
+			return nil
+		}
+	}
+	if !p.exit(fakeProcessState(s)) {
+		return errors.New(errFinished)
+	}
+	return nil
+}
+
+func (p *fakeProcess) Wait() (ProcessState, error) {
+	<-p.exitedChan
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.state.Success() {
+		return p.state, &fakeExitError{p.state}
+	}
+	return p.state, nil
+}
@@ -13,8 +13,10 @@
 package gosh
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"log"
@@ -24,25 +26,42 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+
+	"v.io/x/lib/lookpath"
 )
 
 const (
-	envExitAfter   = "GOSH_EXIT_AFTER"
-	envInvocation  = "GOSH_INVOCATION"
-	envWatchParent = "GOSH_WATCH_PARENT"
+	envExitAfter      = "GOSH_EXIT_AFTER"
+	envInvocation     = "GOSH_INVOCATION"
+	envInvocationFile = "GOSH_INVOCATION_FILE"
+	envSendResult     = "GOSH_SEND_RESULT"
+	envVarsTag        = "GOSH_VARS_TAG"
+	envWatchParent    = "GOSH_WATCH_PARENT"
 )
 
 var (
 	errAlreadyCalledCleanup = errors.New("gosh: already called Shell.Cleanup")
+	errAlreadyStarted       = errors.New("gosh: exec.Cmd already started")
+	errCmdFromOtherShell    = errors.New("gosh: Cmd belongs to a different Shell")
 	errDidNotCallInitMain   = errors.New("gosh: did not call gosh.InitMain")
 	errDidNotCallNewShell   = errors.New("gosh: did not call gosh.NewShell")
+	errLogWithStdoutStderr  = errors.New("gosh: Shell.LogChildOutput cannot be combined with Shell.Stdout or Shell.Stderr")
+	errNoCmds               = errors.New("gosh: no commands given")
+	errNoResult             = errors.New("gosh: child did not send a result")
 )
 
+// resultVar is the name of the var via which a child started by
+// Shell.CallInChild sends the result of its function to the parent.
+const resultVar = "goshResult"
+
 // TB is a subset of the testing.TB interface, defined here to avoid depending
 // on the testing package.
 type TB interface {
@@ -50,38 +69,194 @@ type TB interface {
 	Logf(format string, args ...interface{})
 }
 
+// CleanupTB is a TB that can register functions to call when a test finishes.
+// It is a subset of the testing.TB interface.
+type CleanupTB interface {
+	TB
+	Cleanup(func())
+}
+
 // Shell represents a shell. Not thread-safe.
 type Shell struct {
 	// Err is the most recent error from this Shell or any of its child Cmds (may
-	// be nil).
+	// be nil). Errors from child processes that fail are *ExitErrors, as with
+	// Cmd.Err; use errors.As to get at the underlying *exec.ExitError.
 	Err error
 	// PropagateChildOutput specifies whether to propagate child stdout and stderr
-	// up to the parent's stdout and stderr.
+	// up to the parent's stdout and stderr, or to Shell.Stdout and Shell.Stderr
+	// if set.
 	PropagateChildOutput bool
+	// Stdout and Stderr, if non-nil, are the writers to which child stdout and
+	// stderr are propagated when PropagateChildOutput is true, instead of
+	// os.Stdout and os.Stderr. They must be safe for concurrent use if multiple
+	// children run concurrently.
+	Stdout io.Writer
+	Stderr io.Writer
+	// TimestampChildOutput specifies whether to prefix each line of propagated
+	// child stdout and stderr with an RFC3339Nano timestamp. Only takes effect if
+	// PropagateChildOutput is true.
+	TimestampChildOutput bool
+	// LogChildOutput specifies whether to propagate child stdout and stderr line
+	// by line via TB.Logf, tagged with levels INFO and WARN respectively, instead
+	// of writing them to the parent's stdout and stderr or to Shell.Stdout and
+	// Shell.Stderr. Only takes effect if PropagateChildOutput is true.
+	LogChildOutput bool
 	// ChildOutputDir, if non-empty, makes it so child stdout and stderr are tee'd
-	// to files in the specified directory.
+	// to files in the specified directory. The directory is created if needed.
 	ChildOutputDir string
+	// ChildOutputDirPerRun specifies whether child output files are written to a
+	// new subdirectory of ChildOutputDir for this Shell, rather than to
+	// ChildOutputDir itself, so that the output of each run is grouped together.
+	// The subdirectory is named by the time at which the Shell was created and
+	// the PID of this process, e.g. "20060102.150405.000000.1234".
+	ChildOutputDirPerRun bool
+	// MaxChildOutputRuns, if positive, is the number of per-run subdirectories
+	// of ChildOutputDir to keep when ChildOutputDirPerRun is true. When a Shell
+	// creates its subdirectory, the oldest subdirectories beyond this limit are
+	// removed.
+	MaxChildOutputRuns int
+	// CompressChildOutput specifies whether the child stdout and stderr files
+	// written to ChildOutputDir are gzip-compressed, in which case their names
+	// gain a ".gz" suffix. The files are finalized once each child exits,
+	// including when it is killed by Cleanup.
+	CompressChildOutput bool
 	// ContinueOnError specifies whether to invoke TB.FailNow on error, i.e.
 	// whether to panic on error. Users that set ContinueOnError to true should
 	// inspect sh.Err after each Shell method invocation.
 	ContinueOnError bool
-	// Vars is the map of env vars for this Shell.
+	// CaptureStack, if true, makes HandleError include a stack trace of the
+	// failing call in the logged error message, omitting runtime and testing
+	// frames, so that errors in deeply nested helpers can be traced to their
+	// origin. It applies whether or not ContinueOnError is set.
+	CaptureStack bool
+	// Vars is the map of env vars for this Shell. NewShell initializes it from
+	// the env of the current process, minus gosh control vars. Each Cmd's env is
+	// the parent process's env as of Cmd.Start (unless Cmd.ClearEnv is set), with
+	// the changes made to Shell.Vars (as of Shell.Cmd or Shell.FuncCmd) and then
+	// to Cmd.Vars applied: vars added or changed since NewShell override the
+	// parent's env, and vars deleted since NewShell are unset. Vars whose values
+	// are unchanged since NewShell follow the parent's env, so changes made via
+	// os.Setenv after NewShell are visible to children unless overridden here.
+	// Gosh control vars are added last. Vars does not affect the env of the
+	// current process; for that, use Shell.Setenv.
 	Vars map[string]string
-	// Args is the list of args to append to subsequent command invocations.
+	// Args is the list of args to append to subsequent command invocations
+	// created via Shell.Cmd, Shell.FuncCmd, or CmdTemplate. It is not appended to
+	// commands that gosh runs internally, e.g. "go build" in BuildGoPkg.
 	Args []string
+	// BinName, if non-nil, returns the name of the binary that BuildGoPkg writes
+	// to binDir for the given package, when -o is not specified. If nil,
+	// BuildGoPkg uses the package's base name followed by a short hash of its
+	// full import path, so that distinct packages with the same base name do not
+	// collide.
+	BinName func(pkg string) string
+	// GoBinary is the go command that BuildGoPkg runs, e.g. "go1.21.5" or the path
+	// to a wrapper script. Like Shell.Cmd names, it is resolved using the child's
+	// PATH if it contains no path separators. NewShell sets it to "go".
+	GoBinary string
+	// MaxConcurrentBuilds bounds the number of "go build" processes run at once
+	// by BuildGoPkg across all goroutines using this Shell; builds beyond the
+	// limit wait. NewShell sets it to runtime.GOMAXPROCS(0). Zero or negative
+	// means no limit.
+	MaxConcurrentBuilds int
+	// MaxConcurrentMapChildren bounds the number of child processes that
+	// MapChildren runs at once; inputs beyond the limit wait. NewShell sets it to
+	// runtime.GOMAXPROCS(0). Zero or negative means no limit.
+	MaxConcurrentMapChildren int
+	// MaxRunningCmds, if positive, bounds the number of commands started by this
+	// Shell that may be running at once, e.g. to avoid overwhelming a CI machine.
+	// Once the limit is reached, Cmd.Start blocks until a running command exits.
+	// Detached commands are not counted, nor are the commands that gosh runs
+	// internally, i.e. "go build" for BuildGoPkg and the children of CallInChild
+	// and MapChildren, so these never wait for a slot. Zero or negative means no
+	// limit.
+	MaxRunningCmds int
+	// AllowUnwaitedCmds specifies whether it's expected for commands to still be
+	// running when Cleanup is called, having been started but not waited for. If
+	// false, Cleanup logs a warning for each such command before killing it.
+	AllowUnwaitedCmds bool
+	// CleanupTimeout, if positive, bounds the time taken by Cleanup, e.g. in case
+	// a child is stuck in uninterruptible sleep or a cleanup handler blocks. Once
+	// it elapses, Cleanup logs the steps it abandoned, i.e. the step in progress
+	// and all subsequent steps, and returns; the step in progress continues in the
+	// background, but no longer logs, restores the working dir or env vars, or
+	// deletes temporary files. Each cleanup handler is a separate step.
+	CleanupTimeout time.Duration
+	// VarsTag, if non-empty, replaces "goshVars" in the markers that delimit vars
+	// sent by SendVars, i.e. "<goshVars" and "goshVars>". It is passed to children
+	// via an env var, and is useful for children whose output could otherwise be
+	// mistaken for vars. Must be set before the affected commands are started.
+	VarsTag string
+	// Clock is the source of time for this Shell and its Cmds, used for
+	// timeouts, grace periods, and timestamps. NewShell sets it to a Clock
+	// backed by the time package; tests may replace it.
+	Clock Clock
+	// ManifestPath, if non-empty, is the path of a file to which a JSON-encoded
+	// ManifestEntry is appended for each command as it exits, e.g. to help debug
+	// failures after the fact. The file is created if needed.
+	ManifestPath string
+	// DisableParentDeathSignal specifies whether to not ask the kernel to kill
+	// children when this process dies. By default, on Linux, children other than
+	// those with IgnoreParentExit or Detached set are started with Pdeathsig set
+	// to SIGKILL, so that they are cleaned up even if this process is killed
+	// before it can run Cleanup. This complements the parent watching done by
+	// children created via FuncCmd, and also covers arbitrary binaries. Note, the
+	// signal is actually sent when the thread that started the child exits; the
+	// Go runtime only terminates a thread when a goroutine exits while locked to
+	// it via runtime.LockOSThread, so children should not be started from a
+	// goroutine that does so.
+	DisableParentDeathSignal bool
+	// Backend, if non-nil, launches the commands created by this Shell, e.g. on a
+	// remote host via NewSSHBackend; nil means to run them locally. Commands run
+	// internally by gosh, e.g. "go build", always run locally. Must be set before
+	// the affected commands are created.
+	Backend ExecBackend
+	// Runner, if non-nil, starts the child processes of commands created by this
+	// Shell, e.g. a FakeRunner in tests; nil means to start them via os/exec.
+	// Commands run internally by gosh, e.g. "go build", always use os/exec. Must
+	// be set before the affected commands are created.
+	Runner Runner
+	// Context, if non-nil, is inherited by the commands created by this Shell, so
+	// that canceling it stops all of them at once; see Cmd.Context. It is set by
+	// NewShellContext.
+	Context context.Context
 	// Internal state.
-	calledNewShell  bool
-	tb              TB
-	cleanupDone     chan struct{}
+	calledNewShell bool
+	tb             TB
+	createTime     time.Time  // names the ChildOutputDirPerRun subdirectory
+	manifestMu     sync.Mutex // serializes appends to ManifestPath
+	statsMu        sync.Mutex // protects stats
+	stats          ShellStats
+	abandonMu      sync.Mutex // protects abandoned; held while cleanup steps log
+	abandoned      bool       // Cleanup gave up on a step, per CleanupTimeout
+	// inheritedVars is Vars as initialized by NewShell.
+	inheritedVars   map[string]string
+	buildCond       *sync.Cond // protects numBuilds
+	numBuilds       int        // number of running builds
+	runCond         *sync.Cond // protects numRunning
+	numRunning      int        // number of running commands, per MaxRunningCmds
+	outputDirMu     sync.Mutex // protects madeOutputDir
+	madeOutputDir   string     // child output dir last created by checkConfig
 	cleanupMu       sync.Mutex // protects the fields below; held during cleanup
 	calledCleanup   bool
 	cmds            []*Cmd
 	tempFiles       []*os.File
 	tempDirs        []string
-	dirStack        []string // for pushd/popd
+	invocationFiles []string           // per funcCmd; not in TempPaths
+	dirStack        []string           // for pushd/popd
+	savedEnv        map[string]*string // for setenv; nil means originally unset
 	cleanupHandlers []func()
 }
 
+// NewShellForTest returns a new Shell whose Cleanup is called automatically
+// when the test or benchmark finishes, via tb.Cleanup. It is equivalent to
+// calling NewShell followed by tb.Cleanup(sh.Cleanup).
+func NewShellForTest(tb CleanupTB) *Shell {
+	sh := NewShell(tb)
+	tb.Cleanup(sh.Cleanup)
+	return sh
+}
+
 // NewShell returns a new Shell. Tests and benchmarks should pass their
 // testing.TB instance; non-tests should pass nil.
 func NewShell(tb TB) *Shell {
@@ -90,6 +265,14 @@ func NewShell(tb TB) *Shell {
 	return sh
 }
 
+// NewShellContext is like NewShell, but sets Shell.Context to ctx, so that
+// canceling ctx stops every command started by the returned Shell.
+func NewShellContext(ctx context.Context, tb TB) *Shell {
+	sh := NewShell(tb)
+	sh.Context = ctx
+	return sh
+}
+
 // HandleError sets sh.Err. If err is not nil and sh.ContinueOnError is false,
 // it also calls TB.FailNow.
 func (sh *Shell) HandleError(err error) {
@@ -111,11 +294,15 @@ func (sh *Shell) HandleErrorWithSkip(err error, skip int) {
 	}
 	_, file, line, _ := runtime.Caller(skip)
 	toLog := fmt.Sprintf("%s:%d: %v\n", filepath.Base(file), line, err)
+	if sh.CaptureStack {
+		toLog += callerStack(skip)
+	}
 	if sh.ContinueOnError {
 		sh.tb.Logf(toLog)
 		return
 	}
-	if sh.tb != pkgLevelDefaultTB {
+	// The full stack is redundant if the trimmed one is included in toLog.
+	if sh.tb != pkgLevelDefaultTB && !sh.CaptureStack {
 		sh.tb.Logf(string(debug.Stack()))
 	}
 	// Unfortunately, if FailNow panics, there's no way to make toLog get printed
@@ -124,11 +311,30 @@ func (sh *Shell) HandleErrorWithSkip(err error, skip int) {
 	sh.tb.FailNow()
 }
 
+// callerStack returns a stack trace starting at the caller skip frames up from
+// the caller of callerStack, as for runtime.Caller, omitting runtime and
+// testing frames.
+func callerStack(skip int) string {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip+2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var b strings.Builder
+	for {
+		f, more := frames.Next()
+		if !strings.HasPrefix(f.Function, "runtime.") && !strings.HasPrefix(f.Function, "testing.") {
+			fmt.Fprintf(&b, "\t%s\n\t\t%s:%d\n", f.Function, f.File, f.Line)
+		}
+		if !more {
+			return b.String()
+		}
+	}
+}
+
 // Cmd returns a Cmd for an invocation of the named program. The given arguments
 // are passed to the child as command-line arguments.
 func (sh *Shell) Cmd(name string, args ...string) *Cmd {
 	sh.Ok()
-	res, err := sh.cmd(nil, name, args...)
+	res, err := sh.cmd(nil, name, append(args, sh.Args...)...)
 	sh.handleError(err)
 	return res
 }
@@ -144,12 +350,91 @@ func (sh *Shell) FuncCmd(f *Func, args ...interface{}) *Cmd {
 	return res
 }
 
+// CallInChild runs the given registered Func in a child process, as with
+// FuncCmd, waits for the child to exit, and returns the Func's result, which is
+// gob-encoded in the child and sent back to the parent. Returns nil if the Func
+// has no result. If the Func returns a non-nil error, the child exits with a
+// non-zero code, and the error is reported as for Cmd.Wait.
+func (sh *Shell) CallInChild(f *Func, args ...interface{}) interface{} {
+	sh.Ok()
+	res, err := sh.callInChild(f, args...)
+	sh.handleError(err)
+	return res
+}
+
+// MapChildren calls the given registered Func once per input, each in its own
+// child process as with CallInChild, passing the input as the Func's sole
+// argument, and returns the results in the order of the inputs. At most
+// Shell.MaxConcurrentMapChildren children run at once. If any call fails, the
+// error for the earliest such input is reported, after all children have
+// exited.
+func (sh *Shell) MapChildren(f *Func, inputs []interface{}) []interface{} {
+	sh.Ok()
+	res, err := sh.mapChildren(f, inputs)
+	sh.handleError(err)
+	return res
+}
+
+// Adopt returns a Cmd that wraps the given configured, but not yet started,
+// exec.Cmd, so that it can be managed like any other Cmd, e.g. via AwaitVars,
+// Wait, and Shell.Cleanup. The returned Cmd takes ownership of ec, and runs
+// with ec's Path, Args, Dir, Stdin, ExtraFiles, and SysProcAttr. If ec.Env is
+// nil, the child's env is determined as for Shell.Cmd; otherwise, it is exactly
+// ec.Env, plus gosh control vars. If ec.Stdout or ec.Stderr is set, it is added
+// via AddStdoutWriter or AddStderrWriter.
+func (sh *Shell) Adopt(ec *exec.Cmd) *Cmd {
+	sh.Ok()
+	res, err := sh.adopt(ec)
+	sh.handleError(err)
+	return res
+}
+
+// LookPath returns the absolute path of the named executable. Like
+// exec.LookPath, except that if name contains no path separators, the dirs in
+// the PATH that a child of this Shell would see (per Shell.Vars) are consulted.
+// This is the same resolution that Shell.Cmd uses.
+func (sh *Shell) LookPath(name string) string {
+	sh.Ok()
+	res, err := lookPath(sh.childEnv(sh.Vars), name)
+	sh.handleError(err)
+	return res
+}
+
 // Wait waits for all commands started by this Shell to exit.
 func (sh *Shell) Wait() {
 	sh.Ok()
 	sh.handleError(sh.wait())
 }
 
+// WaitFor is like Wait, but only waits for the given commands, e.g. so that a
+// test can wait for a subset of its commands before starting others. Commands
+// that have not been started, or that have already been waited for, are
+// skipped. Each failure is logged, and the last one is reported to
+// HandleError.
+func (sh *Shell) WaitFor(cmds ...*Cmd) {
+	sh.Ok()
+	sh.handleError(sh.waitFor(cmds))
+}
+
+// WaitAny waits for the first of the given commands to exit, and returns it,
+// e.g. so that a test can detect whether any of its services crashed. All of
+// the given commands must have been started. As with Cmd.Wait, they may already
+// have been waited for, in which case they have exited, and one of them is
+// returned immediately. The call counts as a call to Wait for the returned
+// command only; the others may be waited for later. As with Cmd.Wait, the
+// returned command's error is stored in its Err field and reported to
+// HandleError.
+func (sh *Shell) WaitAny(cmds ...*Cmd) *Cmd {
+	sh.Ok()
+	c, err := sh.waitAny(cmds)
+	if c == nil {
+		sh.handleError(err)
+		return nil
+	}
+	c.handleError(err)
+	return c
+}
+
 // Move moves a file from 'oldpath' to 'newpath'. It first attempts os.Rename;
 // if that fails, it copies 'oldpath' to 'newpath', then deletes 'oldpath'.
 // Requires that 'newpath' does not exist, and that the parent directory of
@@ -160,11 +445,42 @@ func (sh *Shell) Move(oldpath, newpath string) {
 	sh.handleError(sh.move(oldpath, newpath))
 }
 
+// ReadFile returns the contents of the named file.
+func (sh *Shell) ReadFile(path string) []byte {
+	sh.Ok()
+	res, err := ioutil.ReadFile(path)
+	sh.handleError(err)
+	return res
+}
+
+// WriteFile writes data to the named file, creating it with the given
+// permissions if needed, and truncating it otherwise.
+func (sh *Shell) WriteFile(path string, data []byte, perm os.FileMode) {
+	sh.Ok()
+	sh.handleError(ioutil.WriteFile(path, data, perm))
+}
+
+// AppendFile appends data to the named file, creating it with the given
+// permissions if needed.
+func (sh *Shell) AppendFile(path string, data []byte, perm os.FileMode) {
+	sh.Ok()
+	sh.handleError(appendFile(path, data, perm))
+}
+
 // MakeTempFile creates a new temporary file in os.TempDir, opens the file for
 // reading and writing, and returns the resulting *os.File.
 func (sh *Shell) MakeTempFile() *os.File {
 	sh.Ok()
-	res, err := sh.makeTempFile()
+	res, err := sh.makeTempFile("")
+	sh.handleError(err)
+	return res
+}
+
+// MakeTempFilePrefix is like MakeTempFile, but the name of the new file begins
+// with prefix, e.g. "server-".
+func (sh *Shell) MakeTempFilePrefix(prefix string) *os.File {
+	sh.Ok()
+	res, err := sh.makeTempFile(prefix)
 	sh.handleError(err)
 	return res
 }
@@ -173,11 +489,109 @@ func (sh *Shell) MakeTempFile() *os.File {
 // path of the new directory.
 func (sh *Shell) MakeTempDir() string {
 	sh.Ok()
-	res, err := sh.makeTempDir()
+	res, err := sh.makeTempDir("", "")
 	sh.handleError(err)
 	return res
 }
 
+// MakeTempDirPrefix is like MakeTempDir, but the name of the new directory
+// begins with prefix, e.g. "server-".
+func (sh *Shell) MakeTempDirPrefix(prefix string) string {
+	sh.Ok()
+	res, err := sh.makeTempDir("", prefix)
+	sh.handleError(err)
+	return res
+}
+
+// MakeTempDirIn is like MakeTempDirPrefix, but creates the new directory in
+// dir rather than in os.TempDir, e.g. on a scratch disk with room for large
+// files. As with MakeTempDir, the new directory is deleted by Cleanup; dir is
+// not.
+func (sh *Shell) MakeTempDirIn(dir, prefix string) string {
+	sh.Ok()
+	res, err := sh.makeTempDir(dir, prefix)
+	sh.handleError(err)
+	return res
+}
+
+// TempPaths returns the paths of all temporary files and dirs created so far by
+// the MakeTempFile and MakeTempDir methods, files first, each in creation
+// order. Unlike most Shell methods, it may be called when Shell.Err is non-nil,
+// e.g. to log or archive temporary files after a failure, before Cleanup
+// deletes them.
+func (sh *Shell) TempPaths() []string {
+	if !sh.calledNewShell {
+		panic(errDidNotCallNewShell)
+	}
+	return sh.tempPaths()
+}
+
+// Glob returns the names of all files matching pattern, per filepath.Glob. If
+// no files match, it returns an empty slice. A malformed pattern is reported to
+// HandleError.
+func (sh *Shell) Glob(pattern string) []string {
+	sh.Ok()
+	res, err := sh.glob(pattern)
+	sh.handleError(err)
+	return res
+}
+
+// GlobMany is like Glob, but returns the matches for each of the given
+// patterns, in order. As in Bash, a file that matches multiple patterns appears
+// multiple times.
+func (sh *Shell) GlobMany(patterns ...string) []string {
+	sh.Ok()
+	res, err := sh.glob(patterns...)
+	sh.handleError(err)
+	return res
+}
+
+// WithEnv sets the given vars in sh.Vars, calls f, then restores those vars to
+// their previous values (or removes them, if they were previously unset), even
+// if f panics. Thus, commands created inside f inherit vars, like commands run
+// inside "( export X=1; ... )" in Bash. Calls may be nested. Changes made by f
+// to other keys of sh.Vars are preserved.
+func (sh *Shell) WithEnv(vars map[string]string, f func()) {
+	sh.Ok()
+	type oldValue struct {
+		value string
+		ok    bool
+	}
+	old := make(map[string]oldValue, len(vars))
+	for k, v := range vars {
+		value, ok := sh.Vars[k]
+		old[k] = oldValue{value, ok}
+		sh.Vars[k] = v
+	}
+	defer func() {
+		for k, v := range old {
+			if v.ok {
+				sh.Vars[k] = v.value
+			} else {
+				delete(sh.Vars, k)
+			}
+		}
+	}()
+	f()
+}
+
+// Setenv sets an env var in the current process, via os.Setenv. Unlike
+// Shell.Vars, which only affects the env of child processes, Setenv affects the
+// entire process (including, since children inherit the process env, children
+// started afterwards whose Vars don't override it). The var's original value is
+// restored by Cleanup.
+func (sh *Shell) Setenv(key, value string) {
+	sh.Ok()
+	sh.handleError(sh.setenv(key, value))
+}
+
+// Getenv returns the value of an env var in the current process, via
+// os.Getenv. It does not consult Shell.Vars.
+func (sh *Shell) Getenv(key string) string {
+	sh.Ok()
+	return os.Getenv(key)
+}
+
 // Pushd behaves like Bash pushd.
 func (sh *Shell) Pushd(dir string) {
 	sh.Ok()
@@ -192,12 +606,21 @@ func (sh *Shell) Popd() {
 
 // AddCleanupHandler registers the given function to be called during cleanup.
 // Cleanup handlers are called in LIFO order, possibly in a separate goroutine
-// spawned by gosh.
+// spawned by gosh. If a handler panics, the panic is logged, and cleanup
+// continues with the remaining handlers.
 func (sh *Shell) AddCleanupHandler(f func()) {
 	sh.Ok()
 	sh.handleError(sh.addCleanupHandler(f))
 }
 
+// AddCleanupHandlerErr is like AddCleanupHandler, but f is passed the value of
+// Shell.Err at cleanup time, e.g. so that it can preserve temporary files or
+// send a notification only if an error occurred.
+func (sh *Shell) AddCleanupHandlerErr(f func(err error)) {
+	sh.Ok()
+	sh.handleError(sh.addCleanupHandler(func() { f(sh.Err) }))
+}
+
 // Cleanup cleans up all resources (child processes, temporary files and
 // directories) associated with this Shell. It is safe (and recommended) to call
 // Cleanup after a Shell error. It is also safe to call Cleanup multiple times;
@@ -250,67 +673,293 @@ func newShell(tb TB) (*Shell, error) {
 	if tb == nil {
 		tb = pkgLevelDefaultTB
 	}
-	// Filter out any gosh env vars coming from outside.
-	shVars := sliceToMap(os.Environ())
-	for _, key := range []string{envExitAfter, envInvocation, envWatchParent} {
-		delete(shVars, key)
-	}
+	inherited := parentEnv()
 	sh := &Shell{
-		Vars:           shVars,
-		calledNewShell: true,
-		tb:             tb,
-		cleanupDone:    make(chan struct{}),
+		Vars:                     copyMap(inherited),
+		inheritedVars:            inherited,
+		GoBinary:                 "go",
+		MaxConcurrentBuilds:      runtime.GOMAXPROCS(0),
+		MaxConcurrentMapChildren: runtime.GOMAXPROCS(0),
+		Clock:                    realClock{},
+		calledNewShell:           true,
+		tb:                       tb,
+		createTime:               time.Now(),
+		buildCond:                sync.NewCond(&sync.Mutex{}),
+		runCond:                  sync.NewCond(&sync.Mutex{}),
 	}
 	sh.cleanupOnSignal()
 	return sh, nil
 }
 
-// cleanupOnSignal starts a goroutine that calls cleanup if a termination signal
-// is received.
+// liveShells tracks all Shells that have not yet been cleaned up. A single
+// signal handler is installed while any Shell is live; upon receiving a
+// termination signal, it cleans up every live Shell before exiting, so that
+// multiple Shells in one process don't race to exit.
+var liveShells = struct {
+	mu     sync.Mutex
+	shells map[*Shell]bool
+	ch     chan os.Signal // non-nil iff shells is non-empty
+}{shells: map[*Shell]bool{}}
+
+// cleanupOnSignal registers this Shell to be cleaned up if a termination signal
+// is received, installing the signal handler if needed.
 func (sh *Shell) cleanupOnSignal() {
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
-	go func() {
-		select {
-		case sig := <-ch:
-			// A termination signal was received; the process will exit.
-			sh.tb.Logf("Received signal: %v\n", sig)
-			sh.cleanupMu.Lock()
-			defer sh.cleanupMu.Unlock()
-			if !sh.calledCleanup {
-				sh.cleanup()
-			}
-			// Note: We hold cleanupMu during os.Exit(1) so that the main goroutine
-			// will not call Shell.Ok() and panic before we exit.
-			os.Exit(1)
-		case <-sh.cleanupDone:
-			// The user called sh.Cleanup; stop listening for signals and exit this
-			// goroutine.
-		}
-		signal.Stop(ch)
-	}()
+	liveShells.mu.Lock()
+	defer liveShells.mu.Unlock()
+	if len(liveShells.shells) == 0 {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+		go handleSignals(ch)
+		liveShells.ch = ch
+	}
+	liveShells.shells[sh] = true
 }
 
+// stopCleanupOnSignal unregisters this Shell, removing the signal handler if no
+// live Shells remain.
+func (sh *Shell) stopCleanupOnSignal() {
+	liveShells.mu.Lock()
+	defer liveShells.mu.Unlock()
+	if !liveShells.shells[sh] {
+		return
+	}
+	delete(liveShells.shells, sh)
+	if len(liveShells.shells) == 0 {
+		signal.Stop(liveShells.ch)
+		close(liveShells.ch)
+		liveShells.ch = nil
+	}
+}
+
+// handleSignals waits for a termination signal on ch, then cleans up all live
+// Shells and exits. Returns if ch is closed, i.e. if all Shells were cleaned
+// up.
+func handleSignals(ch <-chan os.Signal) {
+	sig, ok := <-ch
+	if !ok {
+		return
+	}
+	// A termination signal was received; the process will exit.
+	liveShells.mu.Lock()
+	shells := make([]*Shell, 0, len(liveShells.shells))
+	for sh := range liveShells.shells {
+		shells = append(shells, sh)
+	}
+	liveShells.mu.Unlock()
+	for _, sh := range shells {
+		sh.tb.Logf("Received signal: %v\n", sig)
+		// Note: We hold cleanupMu during os.Exit(1) so that other goroutines will
+		// not call Shell.Ok() and panic before we exit.
+		sh.cleanupMu.Lock()
+		if !sh.calledCleanup {
+			sh.cleanup()
+		}
+	}
+	os.Exit(1)
+}
+
+// cmd returns a new Cmd configured per this Shell. It does not append sh.Args;
+// callers that create user-requested commands must pass them explicitly, so
+// that they don't leak into commands that gosh runs internally.
 func (sh *Shell) cmd(vars map[string]string, name string, args ...string) (*Cmd, error) {
+	if err := sh.checkConfig(); err != nil {
+		return nil, err
+	}
 	if vars == nil {
 		vars = make(map[string]string)
 	}
-	c, err := newCmd(sh, mergeMaps(sh.Vars, vars), name, append(args, sh.Args...)...)
+	c, err := newCmd(sh, mergeMaps(sh.Vars, vars), name, args...)
 	if err != nil {
 		return nil, err
 	}
 	c.PropagateOutput = sh.PropagateChildOutput
-	c.OutputDir = sh.ChildOutputDir
+	c.TimestampOutput = sh.TimestampChildOutput
+	c.LogOutput = sh.LogChildOutput
+	c.OutputDir = sh.childOutputDir()
+	c.CompressOutput = sh.CompressChildOutput
+	c.Context = sh.Context
 	return c, nil
 }
 
-var executablePath = os.Args[0]
+// checkConfig returns an error if the Shell's configurable fields are
+// contradictory or invalid, so that misconfiguration is reported when a command
+// is created rather than when it is started.
+func (sh *Shell) checkConfig() error {
+	if sh.PropagateChildOutput && sh.LogChildOutput && (sh.Stdout != nil || sh.Stderr != nil) {
+		return errLogWithStdoutStderr
+	}
+	// Only create the output dir once, rather than once per command. Commands
+	// may be created concurrently, e.g. by MapChildren.
+	sh.outputDirMu.Lock()
+	defer sh.outputDirMu.Unlock()
+	if dir := sh.childOutputDir(); dir != "" && dir != sh.madeOutputDir {
+		_, err := os.Stat(dir)
+		created := os.IsNotExist(err)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("gosh: failed to create Shell.ChildOutputDir: %v", err)
+		}
+		if created && sh.ChildOutputDirPerRun && sh.MaxChildOutputRuns > 0 {
+			if err := sh.pruneChildOutputRuns(filepath.Base(dir)); err != nil {
+				return fmt.Errorf("gosh: failed to prune Shell.ChildOutputDir: %v", err)
+			}
+		}
+		sh.madeOutputDir = dir
+	}
+	return nil
+}
+
+// childOutputDir returns the directory to which child output files are
+// written, per ChildOutputDir and ChildOutputDirPerRun.
+func (sh *Shell) childOutputDir() string {
+	if sh.ChildOutputDir == "" || !sh.ChildOutputDirPerRun {
+		return sh.ChildOutputDir
+	}
+	name := sh.createTime.Format("20060102.150405.000000") + "." + strconv.Itoa(os.Getpid())
+	return filepath.Join(sh.ChildOutputDir, name)
+}
 
-func init() {
-	// If exec.LookPath fails, hope for the best.
-	if lp, err := exec.LookPath(executablePath); err != nil {
-		executablePath = lp
+// runDirRegexp matches the names of per-run subdirectories of ChildOutputDir.
+var runDirRegexp = regexp.MustCompile(`^\d{8}\.\d{6}\.\d{6}\.\d+$`)
+
+// pruneChildOutputRuns removes the oldest per-run subdirectories of
+// ChildOutputDir other than the named one, which belongs to this Shell, so that
+// at most MaxChildOutputRuns remain.
+func (sh *Shell) pruneChildOutputRuns(keep string) error {
+	infos, err := ioutil.ReadDir(sh.ChildOutputDir)
+	if err != nil {
+		return err
+	}
+	// ReadDir sorts by name, and names sort chronologically.
+	var runs []string
+	for _, fi := range infos {
+		if fi.IsDir() && runDirRegexp.MatchString(fi.Name()) && fi.Name() != keep {
+			runs = append(runs, fi.Name())
+		}
+	}
+	for ; len(runs) >= sh.MaxChildOutputRuns; runs = runs[1:] {
+		if err := os.RemoveAll(filepath.Join(sh.ChildOutputDir, runs[0])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parentEnv returns the current env of this process, minus any gosh control
+// vars coming from outside.
+func parentEnv() map[string]string {
+	vars := sliceToMap(os.Environ())
+	for _, key := range []string{envExitAfter, envInvocation, envInvocationFile, envSendResult, envVarsTag, envWatchParent} {
+		delete(vars, key)
+	}
+	return vars
+}
+
+// childEnv returns the env, minus gosh control vars, of a child whose vars (per
+// Shell.Vars and Cmd.Vars) are given. See Shell.Vars.
+func (sh *Shell) childEnv(vars map[string]string) map[string]string {
+	res := parentEnv()
+	for k := range sh.inheritedVars {
+		if _, ok := vars[k]; !ok {
+			delete(res, k)
+		}
+	}
+	for k, v := range sh.varOverrides(vars) {
+		res[k] = v
+	}
+	return res
+}
+
+// varOverrides returns the given vars that were added or changed since NewShell
+// initialized Shell.Vars.
+func (sh *Shell) varOverrides(vars map[string]string) map[string]string {
+	res := map[string]string{}
+	for k, v := range vars {
+		if old, ok := sh.inheritedVars[k]; !ok || old != v {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// lookPath resolves name using vars["PATH"]. Mimics
+// https://golang.org/src/os/exec/exec.go Command.
+func lookPath(vars map[string]string, name string) (string, error) {
+	if filepath.Base(name) != name {
+		return name, nil
+	}
+	lp, err := lookpath.Look(vars, name)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return lp, nil
+}
+
+// executablePath is the absolute path to the current executable, re-executed
+// by FuncCmd. It is resolved once, so that changes to the working directory
+// (e.g. via Pushd) do not affect it.
+var executablePath = findExecutablePath()
+
+// findExecutablePath returns the path to the current executable, preferring
+// os.Executable, which does not depend on how the program was invoked.
+func findExecutablePath() string {
+	if p, err := os.Executable(); err == nil {
+		return p
+	}
+	return resolveExecutablePath(os.Args[0])
+}
+
+// resolveExecutablePath returns the absolute path to the executable with the
+// given name, as found by exec.LookPath, or the name itself if the lookup
+// fails.
+func resolveExecutablePath(name string) string {
+	lp, err := exec.LookPath(name)
+	if err != nil {
+		// Hope for the best.
+		return name
+	}
+	if abs, err := filepath.Abs(lp); err == nil {
+		return abs
+	}
+	return lp
+}
+
+func (sh *Shell) adopt(ec *exec.Cmd) (*Cmd, error) {
+	if ec.Process != nil {
+		return nil, errAlreadyStarted
+	}
+	if err := sh.checkConfig(); err != nil {
+		return nil, err
+	}
+	vars := copyMap(sh.Vars)
+	if ec.Env != nil {
+		vars = sliceToMap(ec.Env)
+	}
+	var args []string
+	if len(ec.Args) > 1 {
+		args = ec.Args[1:]
+	}
+	c, err := newCmdInternal(sh, vars, ec.Path, args)
+	if err != nil {
+		return nil, err
+	}
+	c.exactEnv = ec.Env != nil
+	c.ExtraFiles = ec.ExtraFiles
+	c.SysProcAttr = ec.SysProcAttr
+	c.PropagateOutput = sh.PropagateChildOutput
+	c.TimestampOutput = sh.TimestampChildOutput
+	c.LogOutput = sh.LogChildOutput
+	c.OutputDir = sh.childOutputDir()
+	c.CompressOutput = sh.CompressChildOutput
+	c.Context = sh.Context
+	if ec.Stdout != nil {
+		c.stdoutWriters = append(c.stdoutWriters, ec.Stdout)
+	}
+	if ec.Stderr != nil {
+		c.stderrWriters = append(c.stderrWriters, ec.Stderr)
 	}
+	ec.Stdout, ec.Stderr, ec.ExtraFiles = nil, nil, nil
+	c.c = ec
+	return c, nil
 }
 
 func (sh *Shell) funcCmd(f *Func, args ...interface{}) (*Cmd, error) {
@@ -323,16 +972,126 @@ func (sh *Shell) funcCmd(f *Func, args ...interface{}) (*Cmd, error) {
 	if err != nil {
 		return nil, err
 	}
-	vars := map[string]string{envInvocation: string(buf)}
-	return sh.cmd(vars, executablePath)
+	if len(buf) <= maxInvocationVarSize {
+		vars := map[string]string{envInvocation: buf}
+		return sh.cmd(vars, executablePath, sh.Args...)
+	}
+	// The invocation is too large to pass via env var; write it to a temporary
+	// file instead.
+	name, err := sh.makeInvocationFile(buf)
+	if err != nil {
+		return nil, err
+	}
+	vars := map[string]string{envInvocationFile: name}
+	return sh.cmd(vars, executablePath, sh.Args...)
+}
+
+// makeInvocationFile writes the given encoded invocation to a new temporary
+// file, which is deleted by Cleanup, and returns its name.
+func (sh *Shell) makeInvocationFile(buf string) (string, error) {
+	sh.cleanupMu.Lock()
+	defer sh.cleanupMu.Unlock()
+	if sh.calledCleanup {
+		return "", errAlreadyCalledCleanup
+	}
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(buf)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	sh.invocationFiles = append(sh.invocationFiles, f.Name())
+	return f.Name(), nil
+}
+
+func (sh *Shell) callInChild(f *Func, args ...interface{}) (interface{}, error) {
+	c, err := sh.funcCmd(f, args...)
+	if err != nil {
+		return nil, err
+	}
+	c.Vars[envSendResult] = "1"
+	c.internal = true
+	if err := c.run(); err != nil {
+		return nil, err
+	}
+	if !f.hasResult {
+		return nil, nil
+	}
+	c.cond.L.Lock()
+	s, ok := c.recvVars[resultVar]
+	c.cond.L.Unlock()
+	if !ok {
+		return nil, errNoResult
+	}
+	return decodeResult(s)
+}
+
+func (sh *Shell) mapChildren(f *Func, inputs []interface{}) ([]interface{}, error) {
+	n := sh.MaxConcurrentMapChildren
+	if n <= 0 || n > len(inputs) {
+		n = len(inputs)
+	}
+	res := make([]interface{}, len(inputs))
+	errs := make([]error, len(inputs))
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for i, input := range inputs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, input interface{}) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res[i], errs[i] = sh.callInChild(f, input)
+		}(i, input)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// maxInvocationVarSize is the maximum size of an encoded invocation to pass via
+// env var. Operating systems limit the size of individual env vars (e.g. 128KB
+// on Linux) as well as the total size of the env.
+const maxInvocationVarSize = 1 << 15
+
+// readInvocation returns the encoded invocation from the given env, or "" if
+// there is none.
+func readInvocation(getenv func(string) string) (string, error) {
+	if name := getenv(envInvocationFile); name != "" {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("gosh: failed to read invocation: %v", err)
+		}
+		return string(buf), nil
+	}
+	return getenv(envInvocation), nil
 }
 
 func (sh *Shell) wait() error {
 	// Note: It is illegal to call newCmdInternal (which mutates sh.cmds)
 	// concurrently with Shell.wait, so we need not hold cleanupMu when accessing
 	// sh.cmds below.
+	return sh.waitFor(sh.cmds)
+}
+
+func (sh *Shell) waitFor(cmds []*Cmd) error {
+	for _, c := range cmds {
+		if c.sh != sh {
+			return errCmdFromOtherShell
+		}
+	}
 	var res error
-	for _, c := range sh.cmds {
+	for _, c := range cmds {
 		if !c.started || c.calledWait {
 			continue
 		}
@@ -344,6 +1103,48 @@ func (sh *Shell) wait() error {
 	return res
 }
 
+func (sh *Shell) waitAny(cmds []*Cmd) (*Cmd, error) {
+	if len(cmds) == 0 {
+		return nil, errNoCmds
+	}
+	for _, c := range cmds {
+		switch {
+		case c.sh != sh:
+			return nil, errCmdFromOtherShell
+		case !c.started:
+			return nil, ErrNotStarted
+		}
+	}
+	type result struct {
+		c   *Cmd
+		err error
+	}
+	// The channel is buffered so that the goroutines for the other commands can
+	// exit once their commands do. Since reap delivers the same result to all
+	// callers, those commands may still be waited for later.
+	resChan := make(chan result, len(cmds))
+	for _, c := range cmds {
+		go func(c *Cmd) {
+			resChan <- result{c, c.reap()}
+		}(c)
+	}
+	res := <-resChan
+	res.c.calledWait = true
+	return res.c, res.err
+}
+
+func appendFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 func copyFile(to, from string) error {
 	fi, err := os.Stat(from)
 	if err != nil {
@@ -399,13 +1200,13 @@ func (sh *Shell) move(oldpath, newpath string) error {
 	return os.Remove(oldpath)
 }
 
-func (sh *Shell) makeTempFile() (*os.File, error) {
+func (sh *Shell) makeTempFile(prefix string) (*os.File, error) {
 	sh.cleanupMu.Lock()
 	defer sh.cleanupMu.Unlock()
 	if sh.calledCleanup {
 		return nil, errAlreadyCalledCleanup
 	}
-	f, err := ioutil.TempFile("", "")
+	f, err := ioutil.TempFile("", prefix)
 	if err != nil {
 		return nil, err
 	}
@@ -413,13 +1214,13 @@ func (sh *Shell) makeTempFile() (*os.File, error) {
 	return f, nil
 }
 
-func (sh *Shell) makeTempDir() (string, error) {
+func (sh *Shell) makeTempDir(dir, prefix string) (string, error) {
 	sh.cleanupMu.Lock()
 	defer sh.cleanupMu.Unlock()
 	if sh.calledCleanup {
 		return "", errAlreadyCalledCleanup
 	}
-	name, err := ioutil.TempDir("", "")
+	name, err := ioutil.TempDir(dir, prefix)
 	if err != nil {
 		return "", err
 	}
@@ -427,6 +1228,47 @@ func (sh *Shell) makeTempDir() (string, error) {
 	return name, nil
 }
 
+func (sh *Shell) tempPaths() []string {
+	sh.cleanupMu.Lock()
+	defer sh.cleanupMu.Unlock()
+	res := make([]string, 0, len(sh.tempFiles)+len(sh.tempDirs))
+	for _, f := range sh.tempFiles {
+		res = append(res, f.Name())
+	}
+	return append(res, sh.tempDirs...)
+}
+
+func (sh *Shell) glob(patterns ...string) ([]string, error) {
+	res := []string{}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, matches...)
+	}
+	return res, nil
+}
+
+func (sh *Shell) setenv(key, value string) error {
+	sh.cleanupMu.Lock()
+	defer sh.cleanupMu.Unlock()
+	if sh.calledCleanup {
+		return errAlreadyCalledCleanup
+	}
+	if _, ok := sh.savedEnv[key]; !ok {
+		if sh.savedEnv == nil {
+			sh.savedEnv = map[string]*string{}
+		}
+		if old, ok := os.LookupEnv(key); ok {
+			sh.savedEnv[key] = &old
+		} else {
+			sh.savedEnv[key] = nil
+		}
+	}
+	return os.Setenv(key, value)
+}
+
 func (sh *Shell) pushd(dir string) error {
 	sh.cleanupMu.Lock()
 	defer sh.cleanupMu.Unlock()
@@ -471,57 +1313,197 @@ func (sh *Shell) addCleanupHandler(f func()) error {
 	return nil
 }
 
+// cleanupReapTimeout bounds how long Shell.cleanupRunningCmds waits for each
+// terminated command to be reaped, e.g. in case a grandchild that escaped the
+// process group holds one of its output pipes open.
+const cleanupReapTimeout = 5 * time.Second
+
 // Note: It is safe to run Shell.cleanupRunningCmds concurrently with the waiter
 // goroutine and with Cmd.wait. In particular, Shell.cleanupRunningCmds only
-// calls c.{isRunning,Pid}, all of which are thread-safe with the waiter
+// calls c.{isRunning,Pid,reap}, all of which are thread-safe with the waiter
 // goroutine and with Cmd.wait.
 func (sh *Shell) cleanupRunningCmds() {
 	var wg sync.WaitGroup
 	for _, c := range sh.cmds {
-		if !c.started {
+		if !c.started || c.Detached {
 			continue
 		}
+		if !sh.AllowUnwaitedCmds && !c.calledWait && c.isRunning() {
+			sh.cleanupLogf("gosh: command started but not waited for; killing it: %s\n", c.String())
+		}
 		wg.Add(1)
 		go func(cmd *Cmd) {
 			defer wg.Done()
 			cmd.cleanupProcessGroup()
+			// Reap the process, so that its output is flushed to files and writers,
+			// and its pipes are closed, before Cleanup returns.
+			done := make(chan struct{})
+			go func() {
+				cmd.reap()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-sh.clock().After(cleanupReapTimeout):
+				sh.cleanupLogf("gosh: timed out waiting for command to exit: %s\n", cmd.String())
+			}
 		}(c)
 	}
 	wg.Wait()
 }
 
+// callCleanupHandler calls f, logging rather than propagating any panic, so
+// that a buggy handler does not prevent the remaining cleanup steps.
+func (sh *Shell) callCleanupHandler(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			sh.cleanupLogf("gosh: cleanup handler panicked: %v\n%s", r, debug.Stack())
+		}
+	}()
+	f()
+}
+
+// cleanupStep is a step of Shell.cleanup, described by name.
+type cleanupStep struct {
+	name string
+	f    func()
+}
+
 func (sh *Shell) cleanup() {
 	sh.calledCleanup = true
-	// Clean up all children that are still running.
-	sh.cleanupRunningCmds()
-	// Close and delete all temporary files.
+	steps := []cleanupStep{
+		{"killing running commands", sh.cleanupRunningCmds},
+		{"deleting temporary files and dirs", sh.cleanupTempFiles},
+		{"restoring working dir and env vars", sh.restoreDirAndEnv},
+	}
+	// Call cleanup handlers in LIFO order.
+	for i := len(sh.cleanupHandlers) - 1; i >= 0; i-- {
+		f := sh.cleanupHandlers[i]
+		steps = append(steps, cleanupStep{fmt.Sprintf("cleanup handler #%d", i), func() { sh.callCleanupHandler(f) }})
+	}
+	sh.runCleanupSteps(steps)
+	sh.stopCleanupOnSignal()
+}
+
+// runCleanupSteps runs the given steps in order, subject to CleanupTimeout. If
+// a step panics, the panic is propagated to the caller.
+func (sh *Shell) runCleanupSteps(steps []cleanupStep) {
+	if sh.CleanupTimeout <= 0 {
+		for _, step := range steps {
+			step.f()
+		}
+		return
+	}
+	timeout := sh.clock().After(sh.CleanupTimeout)
+	for i, step := range steps {
+		// Each step runs in its own goroutine, where a panic would crash the
+		// process; recover it, and re-panic in the caller's goroutine.
+		done, panicked := make(chan struct{}), make(chan interface{}, 1)
+		go func(f func()) {
+			defer func() {
+				if r := recover(); r != nil {
+					panicked <- r
+				}
+			}()
+			f()
+			close(done)
+		}(step.f)
+		select {
+		case <-done:
+		case r := <-panicked:
+			panic(r)
+		case <-timeout:
+			var names []string
+			for _, step := range steps[i:] {
+				names = append(names, step.name)
+			}
+			sh.abandonMu.Lock()
+			sh.abandoned = true
+			sh.tb.Logf("gosh: cleanup timed out after %v; abandoned: %s\n", sh.CleanupTimeout, strings.Join(names, ", "))
+			sh.abandonMu.Unlock()
+			return
+		}
+	}
+}
+
+// abandonedCleanup returns true iff Cleanup has given up on the step in
+// progress, in which case that step must stop touching Shell and process state.
+func (sh *Shell) abandonedCleanup() bool {
+	sh.abandonMu.Lock()
+	defer sh.abandonMu.Unlock()
+	return sh.abandoned
+}
+
+// cleanupLogf logs from a cleanup step, unless Cleanup has abandoned it, e.g.
+// since sh.tb may belong to a test that has completed by then.
+func (sh *Shell) cleanupLogf(format string, args ...interface{}) {
+	sh.abandonMu.Lock()
+	defer sh.abandonMu.Unlock()
+	if !sh.abandoned {
+		sh.tb.Logf(format, args...)
+	}
+}
+
+// cleanupTempFiles closes and deletes all temporary files, and deletes all
+// temporary dirs. It stops early if Cleanup abandons it.
+func (sh *Shell) cleanupTempFiles() {
 	for _, tempFile := range sh.tempFiles {
+		if sh.abandonedCleanup() {
+			return
+		}
 		name := tempFile.Name()
 		if err := tempFile.Close(); err != nil {
-			sh.tb.Logf("%q.Close() failed: %v\n", name, err)
+			sh.cleanupLogf("%q.Close() failed: %v\n", name, err)
 		}
 		if err := os.RemoveAll(name); err != nil {
-			sh.tb.Logf("os.RemoveAll(%q) failed: %v\n", name, err)
+			sh.cleanupLogf("os.RemoveAll(%q) failed: %v\n", name, err)
+		}
+	}
+	for _, name := range sh.invocationFiles {
+		if sh.abandonedCleanup() {
+			return
+		}
+		if err := os.Remove(name); err != nil {
+			sh.cleanupLogf("os.Remove(%q) failed: %v\n", name, err)
 		}
 	}
 	// Delete all temporary directories.
 	for _, tempDir := range sh.tempDirs {
+		if sh.abandonedCleanup() {
+			return
+		}
 		if err := os.RemoveAll(tempDir); err != nil {
-			sh.tb.Logf("os.RemoveAll(%q) failed: %v\n", tempDir, err)
+			sh.cleanupLogf("os.RemoveAll(%q) failed: %v\n", tempDir, err)
 		}
 	}
+}
+
+// restoreDirAndEnv restores the working dir and env vars changed via Pushd and
+// Setenv. It stops early if Cleanup abandons it, so as not to clobber changes
+// made after Cleanup returns.
+func (sh *Shell) restoreDirAndEnv() {
 	// Change back to the top of the dir stack.
-	if len(sh.dirStack) > 0 {
+	if len(sh.dirStack) > 0 && !sh.abandonedCleanup() {
 		dir := sh.dirStack[0]
 		if err := os.Chdir(dir); err != nil {
-			sh.tb.Logf("os.Chdir(%q) failed: %v\n", dir, err)
+			sh.cleanupLogf("os.Chdir(%q) failed: %v\n", dir, err)
 		}
 	}
-	// Call cleanup handlers in LIFO order.
-	for i := len(sh.cleanupHandlers) - 1; i >= 0; i-- {
-		sh.cleanupHandlers[i]()
+	// Restore env vars changed via Setenv.
+	for key, old := range sh.savedEnv {
+		if sh.abandonedCleanup() {
+			return
+		}
+		var err error
+		if old == nil {
+			err = os.Unsetenv(key)
+		} else {
+			err = os.Setenv(key, *old)
+		}
+		if err != nil {
+			sh.cleanupLogf("restoring env var %q failed: %v\n", key, err)
+		}
 	}
-	close(sh.cleanupDone)
 }
 
 ////////////////////////////////////////
@@ -537,28 +1519,76 @@ func InitMain() {
 		panic("gosh: already called gosh.InitMain")
 	}
 	calledInitMain = true
-	s := os.Getenv(envInvocation)
+	s, err := readInvocation(os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
 	if s == "" {
 		return
 	}
+	sendResult := os.Getenv(envSendResult) != ""
 	os.Unsetenv(envInvocation)
+	os.Unsetenv(envInvocationFile)
+	os.Unsetenv(envSendResult)
 	InitChildMain()
 	name, args, err := decodeInvocation(s)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err := callFunc(name, args...); err != nil {
+	res, err := callFunc(name, args...)
+	if err != nil {
 		log.Fatal(err)
 	}
+	if sendResult {
+		s, err := encodeResult(res)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := SendVars(map[string]string{resultVar: s}); err != nil {
+			log.Fatal(err)
+		}
+	}
 	os.Exit(0)
 }
 
 // BuildGoPkg compiles a Go package using the "go build" command and writes the
 // resulting binary to the given binDir, or to the -o flag location if
-// specified. If -o is relative, it is interpreted as relative to binDir. If the
-// binary already exists at the target location, it is not rebuilt. Returns the
+// specified. If -o is relative, it is interpreted as relative to binDir. If -o
+// is not specified, the binary is named per Shell.BinName. If the binary
+// already exists at the target location, it is not rebuilt. Returns the
 // absolute path to the binary.
 func BuildGoPkg(sh *Shell, binDir, pkg string, flags ...string) string {
+	sh.Ok()
+	res, err := buildGoPkg(sh, binDir, pkg, flags...)
+	sh.handleError(err)
+	return res.BinPath
+}
+
+// BuildGoTestPkg is like BuildGoPkg, but compiles the package's test binary
+// using the "go test -c" command. If -o is not specified, the binary is named
+// per Shell.BinName, followed by ".test".
+func BuildGoTestPkg(sh *Shell, binDir, pkg string, flags ...string) string {
+	sh.Ok()
+	res, err := buildGo(sh, true, binDir, pkg, flags...)
+	sh.handleError(err)
+	return res.BinPath
+}
+
+// BuildResult describes the outcome of BuildGoPkgInfo.
+type BuildResult struct {
+	// BinPath is the absolute path to the binary.
+	BinPath string
+	// Rebuilt is true iff the binary was compiled, i.e. it did not already exist
+	// at BinPath.
+	Rebuilt bool
+	// Duration is how long the call took, including any time spent waiting for
+	// other builds per Shell.MaxConcurrentBuilds.
+	Duration time.Duration
+}
+
+// BuildGoPkgInfo is like BuildGoPkg, but returns a BuildResult that also
+// reports whether the binary was rebuilt, and how long that took.
+func BuildGoPkgInfo(sh *Shell, binDir, pkg string, flags ...string) BuildResult {
 	sh.Ok()
 	res, err := buildGoPkg(sh, binDir, pkg, flags...)
 	sh.handleError(err)
@@ -581,14 +1611,74 @@ func extractOutputFlag(flags ...string) (outputFlag string, otherFlags []string,
 	return
 }
 
-func buildGoPkg(sh *Shell, binDir, pkg string, flags ...string) (string, error) {
+// defaultBinName returns the base name of pkg followed by a short hash of its
+// full import path, e.g. "server.1b2c3d4e".
+func defaultBinName(pkg string) string {
+	h := fnv.New32a()
+	h.Write([]byte(pkg))
+	return fmt.Sprintf("%s.%08x", path.Base(pkg), h.Sum32())
+}
+
+// acquireBuild blocks until fewer than sh.MaxConcurrentBuilds builds are
+// running, then registers a new running build.
+func (sh *Shell) acquireBuild() {
+	sh.buildCond.L.Lock()
+	defer sh.buildCond.L.Unlock()
+	for sh.MaxConcurrentBuilds > 0 && sh.numBuilds >= sh.MaxConcurrentBuilds {
+		sh.buildCond.Wait()
+	}
+	sh.numBuilds++
+}
+
+// releaseBuild unregisters a running build, waking any waiting builds.
+func (sh *Shell) releaseBuild() {
+	sh.buildCond.L.Lock()
+	defer sh.buildCond.L.Unlock()
+	sh.numBuilds--
+	sh.buildCond.Broadcast()
+}
+
+// acquireRun blocks until fewer than sh.MaxRunningCmds commands are running,
+// then registers a new running command.
+func (sh *Shell) acquireRun() {
+	sh.runCond.L.Lock()
+	defer sh.runCond.L.Unlock()
+	for sh.MaxRunningCmds > 0 && sh.numRunning >= sh.MaxRunningCmds {
+		sh.runCond.Wait()
+	}
+	sh.numRunning++
+}
+
+// releaseRun unregisters a running command, waking any waiting commands.
+func (sh *Shell) releaseRun() {
+	sh.runCond.L.Lock()
+	defer sh.runCond.L.Unlock()
+	sh.numRunning--
+	sh.runCond.Broadcast()
+}
+
+func buildGoPkg(sh *Shell, binDir, pkg string, flags ...string) (BuildResult, error) {
+	return buildGo(sh, false, binDir, pkg, flags...)
+}
+
+// buildGo builds the given package's binary, or its test binary if test is
+// true.
+func buildGo(sh *Shell, test bool, binDir, pkg string, flags ...string) (BuildResult, error) {
+	start := sh.clock().Now()
 	outputFlag, flags, err := extractOutputFlag(flags...)
 	if err != nil {
-		return "", err
+		return BuildResult{}, err
 	}
 	var binPath string
 	if outputFlag == "" {
-		binPath = filepath.Join(binDir, path.Base(pkg))
+		binName := sh.BinName
+		if binName == nil {
+			binName = defaultBinName
+		}
+		binPath = filepath.Join(binDir, binName(pkg))
+		if test {
+			binPath += ".test"
+		}
 	} else if filepath.IsAbs(outputFlag) {
 		binPath = outputFlag
 	} else {
@@ -596,35 +1686,54 @@ func buildGoPkg(sh *Shell, binDir, pkg string, flags ...string) (string, error)
 	}
 	// If the binary already exists at the target location, don't rebuild it.
 	if _, err := os.Stat(binPath); err == nil {
-		return binPath, nil
+		return BuildResult{BinPath: binPath, Duration: sh.clock().Now().Sub(start)}, nil
 	} else if !os.IsNotExist(err) {
-		return "", err
+		return BuildResult{}, err
 	}
 	// Build binary to tempBinPath (in a fresh temporary directory), then move it
 	// to binPath.
 	tempDir, err := ioutil.TempDir(binDir, "")
 	if err != nil {
-		return "", err
+		return BuildResult{}, err
 	}
 	defer os.RemoveAll(tempDir)
 	tempBinPath := filepath.Join(tempDir, path.Base(pkg))
 	args := []string{"build", "-o", tempBinPath}
+	if test {
+		args = []string{"test", "-c", "-o", tempBinPath}
+	}
 	args = append(args, flags...)
 	args = append(args, pkg)
-	c, err := sh.cmd(nil, "go", args...)
+	// Builds always run locally via os/exec, even if Shell.Backend or
+	// Shell.Runner is set.
+	goBinary, err := lookPath(sh.childEnv(sh.Vars), sh.GoBinary)
 	if err != nil {
-		return "", err
+		return BuildResult{}, err
 	}
-	if err := c.run(); err != nil {
-		return "", err
+	c, err := sh.cmd(nil, goBinary, args...)
+	if err != nil {
+		return BuildResult{}, err
+	}
+	c.backend, c.runner = nil, nil
+	c.internal = true
+	sh.acquireBuild()
+	err = c.run()
+	sh.releaseBuild()
+	if err != nil {
+		return BuildResult{}, err
 	}
 	// Create target directory, if needed.
 	if err := os.MkdirAll(filepath.Dir(binPath), 0700); err != nil {
-		return "", err
+		return BuildResult{}, err
 	}
 	if err := sh.move(tempBinPath, binPath); err != nil {
-		return "", err
+		return BuildResult{}, err
 	}
 	sh.tb.Logf("Built executable: %s\n", binPath)
-	return binPath, nil
+	d := sh.clock().Now().Sub(start)
+	sh.updateStats(func(s *ShellStats) {
+		s.Builds++
+		s.BuildTime += d
+	})
+	return BuildResult{BinPath: binPath, Rebuilt: true, Duration: d}, nil
 }
@@ -0,0 +1,92 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxConcurrentBuilds(t *testing.T) {
+	sh := NewShell(t)
+	defer sh.Cleanup()
+	if got, want := sh.MaxConcurrentBuilds, runtime.GOMAXPROCS(0); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	sh.MaxConcurrentBuilds = 2
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sh.acquireBuild()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			sh.releaseBuild()
+		}()
+	}
+	wg.Wait()
+	if got, want := maxRunning, int32(2); got != want {
+		t.Errorf("got %v concurrent builds, want %v", got, want)
+	}
+}
+
+func TestResolveExecutablePath(t *testing.T) {
+	// Names found on PATH are resolved.
+	lp, err := exec.LookPath("sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resolveExecutablePath("sh"); got != lp {
+		t.Errorf("got %q, want %q", got, lp)
+	}
+	// Relative paths are made absolute.
+	dir, err := ioutil.TempDir("", "gosh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "exe"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resolveExecutablePath("./exe"), filepath.Join(dir, "exe"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Names that cannot be resolved are left as is, rather than clobbered.
+	const name = "gosh-no-such-executable"
+	if got := resolveExecutablePath(name); got != name {
+		t.Errorf("got %q, want %q", got, name)
+	}
+}
+
+func TestExecutablePathIsAbsolute(t *testing.T) {
+	if !filepath.IsAbs(executablePath) {
+		t.Errorf("got %q, want an absolute path", executablePath)
+	}
+}
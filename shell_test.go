@@ -13,19 +13,26 @@ package gosh_test
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"runtime"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -128,6 +135,9 @@ var (
 	printfFunc = gosh.RegisterFunc("printfFunc", func(format string, v ...interface{}) {
 		fmt.Printf(format, v...)
 	})
+	getenvFunc = gosh.RegisterFunc("getenvFunc", func(key string) {
+		fmt.Print(os.Getenv(key))
+	})
 )
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -169,6 +179,171 @@ func TestCustomTB(t *testing.T) {
 	eq(t, tb.calledFailNow, true)
 }
 
+func TestReadWriteAppendFile(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	name := filepath.Join(sh.MakeTempDir(), "foo")
+	sh.AppendFile(name, []byte("a"), 0600)
+	sh.AppendFile(name, []byte("b"), 0600)
+	eq(t, string(sh.ReadFile(name)), "ab")
+	sh.WriteFile(name, []byte("c"), 0600)
+	eq(t, string(sh.ReadFile(name)), "c")
+	fi, err := os.Stat(name)
+	ok(t, err)
+	eq(t, fi.Mode().Perm(), os.FileMode(0600))
+
+	missing := filepath.Join(sh.MakeTempDir(), "missing", "foo")
+	setsErr(t, sh, func() { sh.ReadFile(missing) })
+	setsErr(t, sh, func() { sh.WriteFile(missing, nil, 0600) })
+	setsErr(t, sh, func() { sh.AppendFile(missing, nil, 0600) })
+}
+
+func TestDetached(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Detached commands cannot have pipes or writers.
+	c := sh.Cmd("true")
+	c.Detached = true
+	c.StdoutPipe()
+	setsErr(t, sh, func() { c.Start() })
+
+	dir := sh.MakeTempDir()
+	sh2 := gosh.NewShell(t)
+	c = sh2.Cmd("sh", "-c", "echo hi; exec sleep 3600")
+	c.Detached = true
+	c.OutputDir = dir
+	c.Start()
+	pid := c.Pid()
+	defer syscall.Kill(pid, syscall.SIGKILL)
+	setsErr(t, sh2, func() { c.AwaitVars("foo") })
+	// The child is a session leader.
+	if stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); err == nil {
+		// The session ID is the fourth field after the parenthesized command name.
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		eq(t, fields[3], strconv.Itoa(pid))
+	}
+	// The child survives Shell.Cleanup.
+	sh2.Cleanup()
+	ok(t, syscall.Kill(pid, 0))
+	// The child's output is written to OutputDir.
+	matches, err := filepath.Glob(filepath.Join(dir, "*.stdout"))
+	ok(t, err)
+	eq(t, len(matches), 1)
+	for i := 0; ; i++ {
+		stdout, err := ioutil.ReadFile(matches[0])
+		ok(t, err)
+		if string(stdout) == "hi\n" {
+			break
+		} else if i == 100 {
+			t.Fatalf("got %q, want %q", stdout, "hi\n")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCleanupUnwaitedCmds(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		tb := &customTB{t: t, buf: &bytes.Buffer{}}
+		sh := gosh.NewShell(tb)
+		sh.AllowUnwaitedCmds = allow
+		running := sh.FuncCmd(sleepFunc, time.Hour, 0)
+		running.Start()
+		running.AwaitVars("ready")
+		waited := sh.FuncCmd(exitFunc, 0)
+		waited.Run()
+		sh.Cleanup()
+		eq(t, strings.Contains(tb.buf.String(), "not waited for"), !allow)
+		eq(t, strings.Contains(tb.buf.String(), running.String()), !allow)
+		eq(t, strings.Contains(tb.buf.String(), waited.String()), false)
+	}
+}
+
+func TestWithEnv(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	sh.Vars["A"] = "a"
+	sh.WithEnv(map[string]string{"A": "a1", "B": "b1"}, func() {
+		eq(t, sh.FuncCmd(getenvFunc, "A").Stdout(), "a1")
+		sh.WithEnv(map[string]string{"B": "b2"}, func() {
+			eq(t, sh.FuncCmd(getenvFunc, "B").Stdout(), "b2")
+		})
+		eq(t, sh.FuncCmd(getenvFunc, "B").Stdout(), "b1")
+		sh.Vars["C"] = "c"
+	})
+	eq(t, sh.Vars["A"], "a")
+	eq(t, sh.Vars["C"], "c")
+	_, hasB := sh.Vars["B"]
+	eq(t, hasB, false)
+
+	// Vars are restored even if f panics.
+	func() {
+		defer func() { recover() }()
+		sh.WithEnv(map[string]string{"A": "a1"}, func() { panic("fake") })
+	}()
+	eq(t, sh.Vars["A"], "a")
+}
+
+func TestSetenv(t *testing.T) {
+	const set, unset = "GOSH_TEST_SETENV_SET", "GOSH_TEST_SETENV_UNSET"
+	os.Setenv(set, "old")
+	defer os.Unsetenv(set)
+	os.Unsetenv(unset)
+
+	sh := gosh.NewShell(t)
+	sh.Setenv(set, "new")
+	sh.Setenv(set, "newer")
+	sh.Setenv(unset, "new")
+	eq(t, sh.Getenv(set), "newer")
+	eq(t, sh.Getenv(unset), "new")
+	// Setenv affects the process env, and thus children.
+	eq(t, os.Getenv(set), "newer")
+	eq(t, sh.FuncCmd(getenvFunc, unset).Stdout(), "new")
+	// Setenv does not affect Shell.Vars, but vars inherited by NewShell follow
+	// the process env.
+	eq(t, sh.Vars[set], "old")
+	eq(t, sh.FuncCmd(getenvFunc, set).Stdout(), "newer")
+
+	// Cleanup restores the original values.
+	sh.Cleanup()
+	eq(t, os.Getenv(set), "old")
+	_, isSet := os.LookupEnv(unset)
+	eq(t, isSet, false)
+}
+
+func TestShellArgs(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	sh.Args = []string{"x"}
+	eq(t, sh.Cmd("echo", "a").Stdout(), "a x\n")
+	eq(t, sh.CmdTemplate(nil, "echo", "a").Instantiate("b").Stdout(), "a b x\n")
+	eq(t, sh.FuncCmd(exitFunc, 0).Args[1:], []string{"x"})
+}
+
+func TestGlob(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	dir := sh.MakeTempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.go"} {
+		ok(t, ioutil.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+	txt, goFiles := filepath.Join(dir, "*.txt"), filepath.Join(dir, "*.go")
+	eq(t, sh.Glob(txt), []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")})
+	eq(t, sh.GlobMany(goFiles, txt), []string{filepath.Join(dir, "c.go"), filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")})
+
+	// A pattern that matches nothing returns an empty slice.
+	eq(t, sh.Glob(filepath.Join(dir, "*.c")), []string{})
+	eq(t, sh.GlobMany(), []string{})
+
+	// A malformed pattern is an error.
+	setsErr(t, sh, func() { sh.Glob("[") })
+	setsErr(t, sh, func() { sh.GlobMany(txt, "[") })
+}
+
 func TestPushdPopd(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
@@ -243,6 +418,93 @@ func TestMakeTempFile(t *testing.T) {
 	eq(t, fi.Mode().IsRegular(), true)
 }
 
+func TestMakeTempPrefix(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	dir := sh.MakeTempDirPrefix("server-")
+	eq(t, strings.HasPrefix(filepath.Base(dir), "server-"), true)
+	fi, err := os.Stat(dir)
+	ok(t, err)
+	eq(t, fi.Mode().IsDir(), true)
+
+	file := sh.MakeTempFilePrefix("db-")
+	eq(t, strings.HasPrefix(filepath.Base(file.Name()), "db-"), true)
+	fi, err = file.Stat()
+	ok(t, err)
+	eq(t, fi.Mode().IsRegular(), true)
+
+	// Both are deleted by Cleanup.
+	sh.Cleanup()
+	for _, name := range []string{dir, file.Name()} {
+		_, err := os.Stat(name)
+		eq(t, os.IsNotExist(err), true)
+	}
+}
+
+func TestMakeTempDirIn(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	base := sh.MakeTempDir()
+	dir := sh.MakeTempDirIn(base, "scratch-")
+	eq(t, filepath.Dir(dir), base)
+	eq(t, strings.HasPrefix(filepath.Base(dir), "scratch-"), true)
+	fi, err := os.Stat(dir)
+	ok(t, err)
+	eq(t, fi.Mode().IsDir(), true)
+
+	// A nonexistent base dir is reported to HandleError.
+	sh.ContinueOnError = true
+	sh.MakeTempDirIn(filepath.Join(base, "missing"), "")
+	eq(t, os.IsNotExist(sh.Err), true)
+	sh.Err = nil
+
+	// The new dir is deleted by Cleanup, even if its base dir is not.
+	other, err := ioutil.TempDir("", "")
+	ok(t, err)
+	defer os.RemoveAll(other)
+	dir = sh.MakeTempDirIn(other, "")
+	sh.Cleanup()
+	_, err = os.Stat(dir)
+	eq(t, os.IsNotExist(err), true)
+	_, err = os.Stat(other)
+	ok(t, err)
+}
+
+func TestTempPaths(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	eq(t, len(sh.TempPaths()), 0)
+	dir := sh.MakeTempDir()
+	file := sh.MakeTempFile()
+	paths := sh.TempPaths()
+	eq(t, paths, []string{file.Name(), dir})
+	// The result is a copy.
+	paths[0] = ""
+	eq(t, sh.TempPaths(), []string{file.Name(), dir})
+
+	// TempPaths may be called concurrently with MakeTempDir.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sh.TempPaths()
+		}()
+		sh.MakeTempDir()
+	}
+	wg.Wait()
+	eq(t, len(sh.TempPaths()), 12)
+
+	// TempPaths may be called after a failure.
+	sh.ContinueOnError = true
+	sh.HandleError(errors.New("oops"))
+	eq(t, len(sh.TempPaths()), 12)
+	sh.Err = nil
+}
+
 func TestMove(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
@@ -325,6 +587,127 @@ func TestShellWait(t *testing.T) {
 	sh.Wait()
 }
 
+func TestShellWaitFor(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	d0 := time.Duration(0)
+	c0 := sh.FuncCmd(sleepFunc, d0, 0)        // not started
+	c1 := sh.FuncCmd(sleepFunc, d0, 0)        // setup, will succeed
+	c2 := sh.FuncCmd(sleepFunc, d0, 1)        // setup, will fail
+	c3 := sh.FuncCmd(sleepFunc, time.Hour, 0) // workload, still running
+	for _, c := range []*gosh.Cmd{c1, c2, c3} {
+		c.Start()
+	}
+
+	// WaitFor only waits for the given commands, and reports their failure.
+	setsErr(t, sh, func() { sh.WaitFor(c0, c1, c2) })
+	// Subsequent calls to Wait return the results that WaitFor saw.
+	c1.Wait()
+	ok(t, c1.Err)
+	setsErr(t, sh, func() { c2.Wait() })
+	c0.Run()
+
+	// A later Shell.Wait waits for the rest.
+	c3.Signal(os.Kill)
+	c3.ExitErrorIsOk = true
+	sh.Wait()
+
+	// WaitFor fails for commands from another Shell.
+	sh2 := gosh.NewShell(t)
+	defer sh2.Cleanup()
+	setsErr(t, sh, func() { sh.WaitFor(sh2.FuncCmd(sleepFunc, d0, 0)) })
+}
+
+func TestShellContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sh := gosh.NewShellContext(ctx, t)
+	defer sh.Cleanup()
+
+	// Commands inherit the Shell's context, unless they override it.
+	c0 := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	eq(t, c0.Context, ctx)
+	c0.Start()
+	c0.AwaitVars("ready")
+	c1 := sh.Cmd("sleep", "3600")
+	c1.Start()
+	c2 := sh.Cmd("true")
+	c2.Context = context.Background()
+
+	// Canceling the context stops running commands, whether or not they handle
+	// the interrupt.
+	cancel()
+	setsErr(t, sh, func() { c0.Wait() })
+	eq(t, c0.Err, context.Canceled)
+	setsErr(t, sh, func() { c1.Wait() })
+	eq(t, c1.Err, context.Canceled)
+
+	// Commands with a done context fail to start, unless they override it.
+	c3 := sh.Cmd("true")
+	setsErr(t, sh, func() { c3.Run() })
+	eq(t, c3.Err, context.Canceled)
+	c2.Run()
+	ok(t, c2.Err)
+}
+
+func TestShellWaitAny(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	d0 := time.Duration(0)
+	c0 := sh.FuncCmd(sleepFunc, time.Hour, 0) // still running
+	c1 := sh.FuncCmd(sleepFunc, d0, 1)        // will fail
+	c0.Start()
+	c1.Start()
+
+	// WaitAny returns the first command to exit, and reports its failure.
+	var c *gosh.Cmd
+	setsErr(t, sh, func() { c = sh.WaitAny(c0, c1) })
+	eq(t, c, c1)
+	eq(t, c1.ExitCode(), 1)
+	eq(t, c0.Done(), false)
+	// As with Wait, commands that were already waited for may be passed again,
+	// and report the same result.
+	c = nil
+	setsErr(t, sh, func() { c = sh.WaitAny(c1) })
+	eq(t, c, c1)
+	// The returned command counts as waited for; the others do not, so they can
+	// still be signaled.
+	c2 := sh.FuncCmd(sleepFunc, d0, 0)
+	c2.Start()
+	eq(t, sh.WaitAny(c0, c2), c2)
+	ok(t, c2.Err)
+	c0.Signal(os.Kill)
+	c0.ExitErrorIsOk = true
+	eq(t, sh.WaitAny(c0), c0)
+
+	// WaitAny fails for commands that were not started, and for commands from
+	// another Shell.
+	setsErr(t, sh, func() { sh.WaitAny(sh.FuncCmd(sleepFunc, d0, 0)) })
+	setsErr(t, sh, func() { sh.WaitAny() })
+	sh2 := gosh.NewShell(t)
+	defer sh2.Cleanup()
+	c3 := sh2.FuncCmd(sleepFunc, d0, 0)
+	c3.Start()
+	setsErr(t, sh, func() { sh.WaitAny(c3) })
+	c3.Wait()
+}
+
+func TestNewShellForTest(t *testing.T) {
+	var dir string
+	t.Run("sub", func(t *testing.T) {
+		sh := gosh.NewShellForTest(t)
+		dir = sh.MakeTempDir()
+		_, err := os.Stat(dir)
+		ok(t, err)
+	})
+	// The Shell was cleaned up when the subtest finished.
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want not exist error", err)
+	}
+}
+
 // Tests that Shell.Ok panics under various conditions.
 func TestOkPanics(t *testing.T) {
 	func() { // errDidNotCallNewShell
@@ -389,6 +772,88 @@ func TestCleanupAfterError(t *testing.T) {
 	sh.Cleanup()
 }
 
+// Tests that cleanup handlers are called in LIFO order, and that handlers added
+// via AddCleanupHandlerErr receive Shell.Err.
+func TestCleanupHandlers(t *testing.T) {
+	var calls []string
+	var gotErr error
+	sh := gosh.NewShell(t)
+	sh.AddCleanupHandler(func() { calls = append(calls, "a") })
+	sh.AddCleanupHandlerErr(func(err error) {
+		calls = append(calls, "b")
+		gotErr = err
+	})
+	sh.Cleanup()
+	eq(t, calls, []string{"b", "a"})
+	eq(t, gotErr, nil)
+
+	sh = gosh.NewShell(t)
+	sh.AddCleanupHandlerErr(func(err error) { gotErr = err })
+	sh.Err = fakeError
+	sh.Cleanup()
+	eq(t, gotErr, fakeError)
+}
+
+// Tests that a panicking cleanup handler is logged, and does not prevent other
+// handlers from being called.
+func TestCleanupHandlerPanic(t *testing.T) {
+	tb := &customTB{t: t, buf: &bytes.Buffer{}}
+	sh := gosh.NewShell(tb)
+	called := false
+	sh.AddCleanupHandler(func() { called = true })
+	sh.AddCleanupHandler(func() { panic("oops") })
+	sh.Cleanup()
+	eq(t, called, true)
+	if !strings.Contains(tb.buf.String(), "cleanup handler panicked: oops") {
+		t.Errorf("panic not logged: %s", tb.buf.String())
+	}
+}
+
+func TestCleanupTimeout(t *testing.T) {
+	tb := &customTB{t: t, buf: &bytes.Buffer{}}
+	sh := gosh.NewShell(tb)
+	sh.CleanupTimeout = 100 * time.Millisecond
+	var called int32
+	sh.AddCleanupHandler(func() { atomic.StoreInt32(&called, 1) })
+	unblock := make(chan struct{})
+	defer close(unblock)
+	sh.AddCleanupHandler(func() { <-unblock })
+	start := time.Now()
+	sh.Cleanup()
+	if d := time.Since(start); d > time.Minute {
+		t.Errorf("Cleanup took %v", d)
+	}
+	eq(t, atomic.LoadInt32(&called), int32(0))
+	if got, want := tb.buf.String(), "abandoned: cleanup handler #1, cleanup handler #0"; !strings.Contains(got, want) {
+		t.Errorf("got %q, want it to contain %q", got, want)
+	}
+}
+
+// panicTB is a TB whose Logf panics, like that of a testing.T whose test has
+// completed.
+type panicTB struct {
+	customTB
+}
+
+func (tb *panicTB) Logf(format string, args ...interface{}) {
+	panic(fmt.Sprintf(format, args...))
+}
+
+// Tests that a panic in a cleanup step is propagated by Cleanup when
+// CleanupTimeout is set, even though the step runs in another goroutine.
+func TestCleanupTimeoutPanic(t *testing.T) {
+	sh := gosh.NewShell(&panicTB{customTB{t: t}})
+	sh.CleanupTimeout = time.Hour
+	// The panic is logged, which panics.
+	sh.AddCleanupHandler(func() { panic("oops") })
+	defer func() {
+		if got, want := fmt.Sprint(recover()), "cleanup handler panicked: oops"; !strings.Contains(got, want) {
+			t.Errorf("got %q, want it to contain %q", got, want)
+		}
+	}()
+	sh.Cleanup()
+}
+
 // Tests that Shell.Cleanup can be called multiple times.
 func TestMultipleCleanup(t *testing.T) {
 	sh := gosh.NewShell(t)
@@ -396,6 +861,82 @@ func TestMultipleCleanup(t *testing.T) {
 	sh.Cleanup()
 }
 
+// Tests that errors can be distinguished using errors.Is and errors.As.
+func TestErrorTypes(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+	sh.ContinueOnError = true
+
+	sh.Cmd("gosh-no-such-executable")
+	eq(t, errors.Is(sh.Err, gosh.ErrNotFound), true)
+	sh.Err = nil
+
+	c := sh.Cmd("sleep", "1")
+	c.Wait()
+	eq(t, errors.Is(sh.Err, gosh.ErrNotStarted), true)
+	sh.Err = nil
+
+	// A file without execute permission cannot be started.
+	notExec := sh.MakeTempFile().Name()
+	c = sh.Cmd(notExec)
+	c.Start()
+	var startErr *gosh.StartError
+	eq(t, errors.As(sh.Err, &startErr), true)
+	eq(t, startErr.Path, notExec)
+	sh.Err = nil
+
+	c = sh.FuncCmd(exitFunc, 3)
+	c.Run()
+	var exitErr *gosh.ExitError
+	eq(t, errors.As(sh.Err, &exitErr), true)
+	eq(t, exitErr.ExitCode(), 3)
+	eq(t, sh.Err.Error(), "exit status 3")
+	var execExitErr *exec.ExitError
+	eq(t, errors.As(sh.Err, &execExitErr), true)
+	sh.Err = nil
+
+	c = sh.Cmd("sleep", "10")
+	c.Start()
+	c.AwaitOutput("foo", 10*time.Millisecond)
+	eq(t, errors.Is(sh.Err, gosh.ErrTimeout), true)
+	var timeoutErr *gosh.TimeoutError
+	eq(t, errors.As(sh.Err, &timeoutErr), true)
+	eq(t, timeoutErr.Timeout, 10*time.Millisecond)
+	sh.Err = nil
+	c.Terminate(os.Interrupt)
+	sh.Err = nil
+
+	c = sh.Cmd("sh", "-c", `echo '<goshVars{"a":}goshVars>' >&2`)
+	c.Run()
+	var protocolErr *gosh.ProtocolError
+	eq(t, errors.As(sh.Err, &protocolErr), true)
+	sh.Err = nil
+}
+
+func captureStackHelper(sh *gosh.Shell) {
+	sh.HandleError(fakeError)
+}
+
+func TestCaptureStack(t *testing.T) {
+	tb := &customTB{t: t, buf: &bytes.Buffer{}}
+	sh := gosh.NewShell(tb)
+	defer sh.Cleanup()
+	sh.CaptureStack = true
+	sh.ContinueOnError = true
+
+	captureStackHelper(sh)
+	got := tb.buf.String()
+	// The stack includes both the helper and its caller, but no testing frames.
+	for _, want := range []string{"gosh_test.captureStackHelper", "gosh_test.TestCaptureStack", "shell_test.go:"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %q, want it to contain %q", got, want)
+		}
+	}
+	if strings.Contains(got, "testing.tRunner") || strings.Contains(got, "HandleErrorWithSkip") {
+		t.Errorf("stack was not trimmed: %s", got)
+	}
+}
+
 // Tests that Shell.HandleError logs errors using an appropriate runtime.Caller
 // skip value.
 func TestHandleErrorLogging(t *testing.T) {
@@ -461,7 +1002,7 @@ func TestCmd(t *testing.T) {
 	binPath := gosh.BuildGoPkg(sh, binDir, "github.com/asadovsky/gosh/internal/gosh_example_server")
 	c := sh.Cmd(binPath)
 	c.Start()
-	addr := c.AwaitVars("addr")["addr"]
+	addr := c.AwaitAddr()
 	neq(t, addr, "")
 
 	// Run client.
@@ -483,7 +1024,7 @@ func TestFuncCmd(t *testing.T) {
 	// Start server.
 	c := sh.FuncCmd(serveFunc)
 	c.Start()
-	addr := c.AwaitVars("addr")["addr"]
+	addr := c.AwaitAddr()
 	neq(t, addr, "")
 
 	// Run client.
@@ -502,82 +1043,973 @@ func TestLookPath(t *testing.T) {
 	relName := "hw"
 	absName := filepath.Join(binDir, relName)
 	gosh.BuildGoPkg(sh, "", helloWorldPkg, "-o", absName)
+	eq(t, sh.LookPath(relName), absName)
 	c := sh.Cmd(relName)
 	eq(t, c.Stdout(), helloWorldStr)
 
 	// Test the case where we cannot find the executable.
 	sh.Vars["PATH"] = ""
+	setsErr(t, sh, func() { sh.LookPath("yes") })
 	setsErr(t, sh, func() { sh.Cmd("yes") })
 }
 
-var (
-	sendVarsFunc = gosh.RegisterFunc("sendVarsFunc", func(vars map[string]string) {
-		gosh.SendVars(vars)
-		time.Sleep(time.Hour)
-	})
-	stderrFunc = gosh.RegisterFunc("stderrFunc", func(s string) {
-		fmt.Fprintf(os.Stderr, s)
-		time.Sleep(time.Hour)
-	})
-)
+// Tests that a Cmd's env is the parent's current env, overlaid by Shell.Vars,
+// overlaid by Cmd.Vars.
+func TestVars(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
 
-// Tests that AwaitVars works under various conditions.
-func TestAwaitVars(t *testing.T) {
+	const key = "GOSH_TEST_VAR"
+	defer os.Unsetenv(key)
+
+	// Changes to the parent's env after NewShell are visible to children.
+	ok(t, os.Setenv(key, "parent"))
+	eq(t, sh.FuncCmd(getenvFunc, key).Stdout(), "parent")
+
+	// Shell.Vars overrides the parent's env.
+	sh.Vars[key] = "shell"
+	eq(t, sh.FuncCmd(getenvFunc, key).Stdout(), "shell")
+
+	// Cmd.Vars overrides Shell.Vars.
+	c := sh.FuncCmd(getenvFunc, key)
+	c.Vars[key] = "cmd"
+	eq(t, c.Stdout(), "cmd")
+
+	// Shell.Vars is captured when the Cmd is created, whereas the parent's env is
+	// captured when the Cmd is started.
+	delete(sh.Vars, key)
+	c = sh.FuncCmd(getenvFunc, key)
+	sh.Vars[key] = "shell"
+	ok(t, os.Setenv(key, "parent2"))
+	eq(t, c.Stdout(), "parent2")
+}
+
+// Tests that Shell.Vars starts as a copy of the parent's env, and that deleting
+// an inherited var unsets it in children.
+func TestVarsInherited(t *testing.T) {
+	const key = "GOSH_TEST_VAR"
+	ok(t, os.Setenv(key, "parent"))
+	defer os.Unsetenv(key)
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
-	c := sh.FuncCmd(sendVarsFunc, map[string]string{"a": "1"})
-	c.Start()
-	eq(t, c.AwaitVars("a")["a"], "1")
+	eq(t, sh.Vars[key], "parent")
+	eq(t, sh.Vars["PATH"], os.Getenv("PATH"))
+	eq(t, sh.FuncCmd(getenvFunc, key).Stdout(), "parent")
 
-	c = sh.FuncCmd(stderrFunc, `<goshVars{"a":"1","b":"2"}goshVars>`)
-	c.Start()
-	vars := c.AwaitVars("a", "b")
-	eq(t, vars["a"], "1")
-	eq(t, vars["b"], "2")
+	// Unchanged inherited vars follow the parent's env.
+	ok(t, os.Setenv(key, "parent2"))
+	eq(t, sh.FuncCmd(getenvFunc, key).Stdout(), "parent2")
 
-	c = sh.FuncCmd(stderrFunc, `<goshVars{"a":"1"}goshVars><gosh`)
-	c.Start()
-	eq(t, c.AwaitVars("a")["a"], "1")
+	// Deleting an inherited var unsets it.
+	delete(sh.Vars, key)
+	c := sh.Cmd("sh", "-c", "echo ${"+key+"-unset}")
+	eq(t, c.Stdout(), "unset\n")
+	_, _, removed := c.EnvDiff()
+	eq(t, removed[key], "parent2")
+}
 
-	c = sh.FuncCmd(stderrFunc, `<goshVars{"a":"1"}goshVars><goshVars{"b":"2"}goshVars>`)
-	c.Start()
-	vars = c.AwaitVars("a", "b")
-	eq(t, vars["a"], "1")
-	eq(t, vars["b"], "2")
+// Tests that Cmd.Wrapper runs the command through the given wrapper, and that
+// FuncCmd works through the wrapper.
+func TestWrapper(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
 
-	c = sh.FuncCmd(stderrFunc, `<goshVars{"a":"1","b":"2"}goshVars>`)
-	c.Start()
-	vars = c.AwaitVars("a")
-	eq(t, vars["a"], "1")
-	eq(t, vars["b"], "")
-	vars = c.AwaitVars("b")
-	eq(t, vars["a"], "")
-	eq(t, vars["b"], "2")
+	const key = "GOSH_TEST_VAR"
+	c := sh.FuncCmd(getenvFunc, key)
+	c.Wrapper = []string{"env", key + "=wrapped"}
+	eq(t, c.Stdout(), "wrapped")
 
-	c = sh.FuncCmd(stderrFunc, `<g<goshVars{"a":"goshVars"}goshVars>s><goshVars`)
-	c.Start()
-	eq(t, c.AwaitVars("a")["a"], "goshVars")
+	c = sh.FuncCmd(echoFunc)
+	c.Args = append(c.Args, "foo")
+	c.Wrapper = []string{"env"}
+	eq(t, c.Stdout(), "foo\n")
 
-	c = sh.FuncCmd(stderrFunc, `<<goshVars{"a":"1"}goshVars>><<goshVars{"b":"<goshVars"}goshVars>>`)
-	c.Start()
-	vars = c.AwaitVars("a", "b")
-	eq(t, vars["a"], "1")
-	eq(t, vars["b"], "<goshVars")
+	// The wrapper must exist.
+	c = sh.FuncCmd(echoFunc)
+	c.Wrapper = []string{"/#invalid#/!wrapper!"}
+	setsErr(t, sh, c.Start)
 }
 
-// Tests that AwaitVars returns immediately when the process exits.
-func TestAwaitVarsProcessExit(t *testing.T) {
+func TestNice(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
-	c := sh.FuncCmd(exitFunc, 0)
+	// The "nice" command prints the niceness it inherited from its parent. It
+	// runs without waiting, so this checks that Nice is applied before exec.
+	c := sh.Cmd("nice")
+	c.Nice = 5
+	eq(t, c.Stdout(), "5\n")
+
+	// Out-of-range values are rejected.
+	c = sh.Cmd("nice")
+	c.Nice = 20
+	setsErr(t, sh, c.Start)
+
+	// A missing nice command is reported as such.
+	c = sh.Cmd("/bin/echo")
+	c.Vars["PATH"] = sh.MakeTempDir()
+	c.Nice = 5
+	setsErr(t, sh, c.Start)
+	eq(t, errors.Is(c.Err, gosh.ErrNotFound), true)
+	eq(t, strings.Contains(c.Err.Error(), "Cmd.Nice"), true)
+}
+
+var spinFunc = gosh.RegisterFunc("spinFunc", func() {
+	for {
+	}
+})
+
+func TestLimits(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Exceeding the CPU limit is reported as ErrCPULimitExceeded.
+	c := sh.FuncCmd(spinFunc)
+	c.Limits.MaxCPUSeconds = 1
+	setsErr(t, sh, c.Run)
+	eq(t, c.Err, gosh.ErrCPULimitExceeded)
+
+	// A SIGKILL sent by gosh is not attributed to the CPU limit, even after the
+	// process has reached the soft limit.
+	c = sh.FuncCmd(spinFunc)
+	c.Limits.MaxCPUSeconds = 1
 	c.Start()
-	setsErr(t, sh, func() { c.AwaitVars("foo") })
+	time.Sleep(1500 * time.Millisecond)
+	c.Signal(os.Kill)
+	setsErr(t, sh, c.Wait)
+	eq(t, c.Err.Error(), "signal: killed")
+
+	// The limits are in place before the command runs. Note, "ulimit -v" reports
+	// the limit in KiB.
+	c = sh.Cmd("sh", "-c", "ulimit -v; ulimit -S -t; ulimit -H -t")
+	c.Limits = gosh.Limits{MaxMemoryBytes: 4 << 30, MaxCPUSeconds: 5}
+	eq(t, c.Stdout(), "4194304\n5\n6\n")
+
+	// Nice and Limits compose.
+	c = sh.Cmd("nice")
+	c.Nice, c.Limits.MaxCPUSeconds = 5, 5
+	eq(t, c.Stdout(), "5\n")
 }
 
-// Functions designed for TestRegistry.
-var (
+func TestCredential(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Running as the parent's own user never requires privilege.
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	c := sh.Cmd("id", "-u")
+	c.Credential = &syscall.Credential{Uid: uid, Gid: gid, NoSetGroups: true}
+	eq(t, c.Stdout(), fmt.Sprintf("%d\n", uid))
+
+	if uid == 0 {
+		c = sh.Cmd("id", "-u")
+		c.Credential = &syscall.Credential{Uid: 65534, Gid: 65534}
+		eq(t, c.Stdout(), "65534\n")
+	} else {
+		// Without privilege, Start fails.
+		c = sh.Cmd("id", "-u")
+		c.Credential = &syscall.Credential{Uid: 0, Gid: 0}
+		setsErr(t, sh, c.Start)
+	}
+}
+
+func TestSysProcAttr(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("test reads /proc")
+	}
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Prints "<pid> <pgrp> <session>" for the shell itself.
+	const script = `read -r pid comm state ppid pgrp session rest < /proc/self/stat; echo $pid $pgrp $session`
+	ids := func(c *gosh.Cmd) []string {
+		return strings.Fields(c.Stdout())
+	}
+
+	// User-specified attributes are applied. Changing the uid requires root.
+	if os.Getuid() == 0 {
+		c := sh.Cmd("id", "-u")
+		c.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+		eq(t, c.Stdout(), "65534\n")
+	}
+
+	// Process group and session settings are overridden by gosh: the child is
+	// in its own process group, but not its own session.
+	c := sh.Cmd("sh", "-c", script)
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	got := ids(c)
+	eq(t, got[1], got[0])
+	neq(t, got[2], got[0])
+}
+
+// Tests that Cmd.ClearEnv drops the parent's env, but keeps Cmd.Vars and the
+// gosh control vars needed by FuncCmd.
+func TestClearEnv(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	const key = "GOSH_TEST_VAR"
+	defer os.Unsetenv(key)
+	ok(t, os.Setenv(key, "parent"))
+
+	c := sh.FuncCmd(getenvFunc, key)
+	c.ClearEnv = true
+	eq(t, c.Stdout(), "")
+
+	c = sh.FuncCmd(getenvFunc, "HOME")
+	c.ClearEnv = true
+	eq(t, c.Stdout(), "")
+
+	c = sh.FuncCmd(getenvFunc, key)
+	c.ClearEnv = true
+	c.Vars[key] = "cmd"
+	eq(t, c.Stdout(), "cmd")
+}
+
+var lenFunc = gosh.RegisterFunc("lenFunc", func(s string) {
+	fmt.Print(len(s))
+})
+
+// Tests that FuncCmd supports invocations too large to pass via env var.
+func TestFuncCmdLargeArgs(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	const n = 1 << 20
+	c := sh.FuncCmd(lenFunc, strings.Repeat("a", n))
+	eq(t, c.FuncName(), "lenFunc")
+	eq(t, c.Stdout(), strconv.Itoa(n))
+	// The file holding the invocation is internal, so it is not reported by
+	// TempPaths.
+	eq(t, len(sh.TempPaths()), 0)
+}
+
+var batchFuncs = gosh.RegisterFuncs(map[string]interface{}{
+	"upperFunc": func(s string) { fmt.Print(strings.ToUpper(s)) },
+	"lowerFunc": func(s string) { fmt.Print(strings.ToLower(s)) },
+})
+
+var autoFunc = gosh.RegisterFuncAuto(lib.Get)
+
+func TestRegisterFuncAuto(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(serveFunc)
+	c.Start()
+	addr := c.AwaitAddr()
+	c = sh.FuncCmd(autoFunc, addr)
+	eq(t, c.FuncName(), "github.com/asadovsky/gosh/internal/gosh_example_lib.Get")
+	eq(t, c.Stdout(), helloWorldStr)
+}
+
+func TestRegisterFuncs(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	eq(t, sh.FuncCmd(batchFuncs["upperFunc"], "Foo").Stdout(), "FOO")
+	eq(t, sh.FuncCmd(batchFuncs["lowerFunc"], "Foo").Stdout(), "foo")
+
+	// Registering the same batch twice from the same call site panics, as does
+	// reusing a name registered from another call site, and invalid funcs are
+	// rejected.
+	for i := 0; i < 2; i++ {
+		func() {
+			if i == 1 {
+				defer func() { neq(t, recover(), nil) }()
+			}
+			gosh.RegisterFuncs(map[string]interface{}{"twiceFunc": func() {}})
+		}()
+	}
+	func() {
+		defer func() { neq(t, recover(), nil) }()
+		gosh.RegisterFuncs(map[string]interface{}{"newFunc": func() {}, "catFunc": func() {}})
+	}()
+	func() {
+		defer func() { neq(t, recover(), nil) }()
+		gosh.RegisterFuncs(map[string]interface{}{"okFunc": func() {}, "badFunc": 1})
+	}()
+	// Funcs in a rejected batch are not registered.
+	gosh.RegisterFuncs(map[string]interface{}{"newFunc": func() {}, "okFunc": func() {}})
+}
+
+var contextFunc = gosh.RegisterFunc("contextFunc", func(ctx context.Context, s string) error {
+	gosh.SendVars(map[string]string{"ready": ""})
+	<-ctx.Done()
+	fmt.Print(s)
+	return nil
+})
+
+var ignoreContextFunc = gosh.RegisterFunc("ignoreContextFunc", func(ctx context.Context) {
+	gosh.SendVars(map[string]string{"ready": ""})
+	select {}
+})
+
+// Tests that a leading context.Context parameter is supplied by the child, and
+// is canceled when the child receives SIGINT.
+func TestFuncCmdContext(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(contextFunc, "canceled")
+	eq(t, c.FuncArgs(), []interface{}{"canceled"})
+	stdout := c.StdoutPipe()
+	c.Start()
+	c.AwaitVars("ready")
+	c.Signal(os.Interrupt)
+	b, err := ioutil.ReadAll(stdout)
+	ok(t, err)
+	eq(t, string(b), "canceled")
+	c.Wait()
+
+	// The context is not passed by the caller.
+	sh.ContinueOnError = true
+	sh.FuncCmd(contextFunc)
+	nok(t, sh.Err)
+	sh.Err = nil
+
+	// A function that ignores its context is still killed by the signal, after
+	// a grace period.
+	c = sh.FuncCmd(ignoreContextFunc)
+	c.Start()
+	c.AwaitVars("ready")
+	c.Signal(os.Interrupt)
+	c.Wait()
+	eq(t, c.Err.Error(), "signal: interrupt")
+}
+
+type unexportedFields struct {
+	a int
+}
+
+type exportedFields struct {
+	A int
+	f func()
+}
+
+// Tests that RegisterFunc rejects functions whose arg types can never be
+// gob-encoded.
+func TestRegisterFuncArgTypes(t *testing.T) {
+	for _, fi := range []interface{}{
+		func(chan int) {},
+		func(int, func()) {},
+		func(unexportedFields) {},
+		func(...map[string]chan bool) {},
+	} {
+		func() {
+			defer func() { neq(t, recover(), nil) }()
+			gosh.RegisterFunc("badArgsFunc", fi)
+		}()
+	}
+	gosh.RegisterFunc("goodArgsFunc", func(time.Time, *exportedFields, []interface{}) {})
+}
+
+// Tests that RegisterFunc rejects functions with unsupported results.
+func TestRegisterFuncResultTypes(t *testing.T) {
+	for _, fi := range []interface{}{
+		func() (error, int) { return nil, 0 },
+		func() (int, int) { return 0, 0 },
+		func() (int, string, error) { return 0, "", nil },
+		func() chan int { return nil },
+	} {
+		func() {
+			defer func() { neq(t, recover(), nil) }()
+			gosh.RegisterFunc("badResultFunc", fi)
+		}()
+	}
+}
+
+var (
+	squareFunc = gosh.RegisterFunc("squareFunc", func(x int) int {
+		return x * x
+	})
+	divideFunc = gosh.RegisterFunc("divideFunc", func(x, y int) (map[string]int, error) {
+		if y == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return map[string]int{"q": x / y, "r": x % y}, nil
+	})
+)
+
+func TestCallInChild(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	eq(t, sh.CallInChild(squareFunc, 7), 49)
+	eq(t, sh.CallInChild(divideFunc, 7, 2), map[string]int{"q": 3, "r": 1})
+	// Funcs without results return nil.
+	eq(t, sh.CallInChild(exitFunc, 0), nil)
+
+	// Errors returned by the Func are reported.
+	sh.ContinueOnError = true
+	eq(t, sh.CallInChild(divideFunc, 7, 0), nil)
+	nok(t, sh.Err)
+	sh.Err = nil
+	// As are invalid arguments.
+	sh.CallInChild(squareFunc, "7")
+	nok(t, sh.Err)
+}
+
+func TestMapChildren(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	inputs := []interface{}{1, 2, 3, 4, 5}
+	want := []interface{}{1, 4, 9, 16, 25}
+	eq(t, sh.MapChildren(squareFunc, inputs), want)
+	sh.MaxConcurrentMapChildren = 1
+	eq(t, sh.MapChildren(squareFunc, inputs), want)
+	eq(t, len(sh.MapChildren(squareFunc, nil)), 0)
+
+	// If any call fails, no results are returned.
+	sh.ContinueOnError = true
+	eq(t, sh.MapChildren(squareFunc, []interface{}{1, "2"}), []interface{}(nil))
+	nok(t, sh.Err)
+	sh.Err = nil
+
+	// Children may write to Shell.ChildOutputDir concurrently.
+	sh.ContinueOnError = false
+	sh.MaxConcurrentMapChildren = 0
+	sh.ChildOutputDir = filepath.Join(sh.MakeTempDir(), "out")
+	eq(t, sh.MapChildren(squareFunc, inputs), want)
+}
+
+func TestCmdTemplate(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	vars := map[string]string{"A": "1"}
+	tmpl := sh.CmdTemplate(vars, "sh", "-c", `echo $A "$@"`, "sh")
+	// Mutating the original vars does not affect the template.
+	vars["A"] = "2"
+	eq(t, tmpl.Instantiate().Stdout(), "1\n")
+	eq(t, tmpl.Instantiate("x").Stdout(), "1 x\n")
+	c := tmpl.Instantiate("y", "z")
+	c.Vars["A"] = "3"
+	eq(t, c.Stdout(), "3 y z\n")
+	eq(t, tmpl.Instantiate("x").Stdout(), "1 x\n")
+
+	// Name resolution happens at template creation time.
+	sh.Vars["PATH"] = ""
+	setsErr(t, sh, func() { sh.CmdTemplate(nil, "sh") })
+}
+
+func TestCmdString(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.Cmd("/bin/echo", "foo", "a b", "it's")
+	c.Vars["A"], c.Vars["B"] = "1", "x y"
+	eq(t, c.String(), `A=1 B='x y' /bin/echo foo 'a b' 'it'\''s'`)
+
+	c.Wrapper = []string{"/usr/bin/env", "-i"}
+	eq(t, c.String(), `A=1 B='x y' /usr/bin/env -i /bin/echo foo 'a b' 'it'\''s'`)
+
+	// For FuncCmd, the invocation is described in a trailing comment.
+	c = sh.FuncCmd(printfFunc, "%v %v", 1, "foo")
+	if got, want := c.String(), ` # printfFunc("%v %v", 1, "foo")`; !strings.HasSuffix(got, want) {
+		t.Fatalf("got %v, want suffix %v", got, want)
+	}
+}
+
+// Tests that Cmd.String omits vars inherited from the parent env.
+func TestCmdStringOmitsInheritedVars(t *testing.T) {
+	ok(t, os.Setenv("GOSH_TEST_SECRET", "hunter2"))
+	defer os.Unsetenv("GOSH_TEST_SECRET")
+	ok(t, os.Setenv("GOSH_TEST_UNSET", "1"))
+	defer os.Unsetenv("GOSH_TEST_UNSET")
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.Cmd("/bin/echo", "foo")
+	c.Vars["A"] = "1"
+	delete(c.Vars, "GOSH_TEST_UNSET")
+	eq(t, c.String(), `env -u GOSH_TEST_UNSET A=1 /bin/echo foo`)
+
+	c.ClearEnv = true
+	eq(t, c.String(), `env -i A=1 /bin/echo foo`)
+}
+
+func TestEnvDiff(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+	ok(t, os.Setenv("GOSH_TEST_A", "1"))
+	defer os.Unsetenv("GOSH_TEST_A")
+	ok(t, os.Setenv("GOSH_TEST_B", "2"))
+	defer os.Unsetenv("GOSH_TEST_B")
+
+	sh.Vars["GOSH_TEST_A"] = "x"
+	c := sh.Cmd("/bin/echo")
+	c.Vars["GOSH_TEST_C"] = "3"
+	added, changed, removed := c.EnvDiff()
+	eq(t, added, map[string]string{"GOSH_TEST_C": "3", "GOSH_WATCH_PARENT": "1"})
+	eq(t, changed, map[string]string{"GOSH_TEST_A": "x"})
+	eq(t, removed, map[string]string{})
+
+	c.ClearEnv = true
+	c.IgnoreParentExit = true
+	_, _, removed = c.EnvDiff()
+	eq(t, removed["GOSH_TEST_B"], "2")
+	_, found := removed["GOSH_TEST_A"]
+	eq(t, found, false)
+}
+
+func TestFuncNameArgs(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(printfFunc, "%v %v", 1, "foo")
+	eq(t, c.FuncName(), "printfFunc")
+	eq(t, c.FuncArgs(), []interface{}{"%v %v", 1, "foo"})
+	c.Run()
+	eq(t, c.FuncName(), "printfFunc")
+	eq(t, c.FuncArgs(), []interface{}{"%v %v", 1, "foo"})
+
+	c = sh.FuncCmd(printFunc)
+	eq(t, c.FuncName(), "printFunc")
+	eq(t, len(c.FuncArgs()), 0)
+
+	c = sh.Cmd("/bin/echo")
+	eq(t, c.FuncName(), "")
+	eq(t, c.FuncArgs(), []interface{}(nil))
+}
+
+func TestAdopt(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// The exec.Cmd's config is preserved, and the gosh control protocol works.
+	dir := sh.MakeTempDir()
+	var stdout bytes.Buffer
+	ec := exec.Command("sh", "-c", `pwd; echo $FOO; echo '<goshVars{"a":"1"}goshVars>' >&2`)
+	ec.Dir = dir
+	ec.Env = []string{"FOO=bar"}
+	ec.Stdout = &stdout
+	c := sh.Adopt(ec)
+	eq(t, c.Describe().Dir, dir)
+	c.Start()
+	eq(t, c.AwaitVars("a")["a"], "1")
+	c.Wait()
+	eq(t, stdout.String(), dir+"\nbar\n")
+
+	// A nil Env means the child's env is determined as for Shell.Cmd.
+	sh.Vars["FOO"] = "baz"
+	eq(t, sh.Adopt(exec.Command("sh", "-c", "echo $FOO")).Stdout(), "baz\n")
+
+	// The exec.Cmd's SysProcAttr is used.
+	ec = exec.Command("true")
+	ec.SysProcAttr = &syscall.SysProcAttr{Chroot: "/nonexistent-dir"}
+	c = sh.Adopt(ec)
+	eq(t, c.SysProcAttr, ec.SysProcAttr)
+	setsErr(t, sh, func() { c.Run() })
+	var startErr *gosh.StartError
+	eq(t, errors.As(c.Err, &startErr), true)
+
+	// Adopting a started exec.Cmd fails.
+	ec = exec.Command("true")
+	ok(t, ec.Run())
+	setsErr(t, sh, func() { sh.Adopt(ec) })
+}
+
+func TestCmdDescribe(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.Cmd("/bin/echo", "foo")
+	c.Vars["A"] = "1"
+	c.ClearEnv = true
+	d := c.Describe()
+	eq(t, d.Path, "/bin/echo")
+	eq(t, d.Args, []string{"/bin/echo", "foo"})
+	cwd, err := os.Getwd()
+	ok(t, err)
+	eq(t, d.Dir, cwd)
+	eq(t, d.Env["A"], "1")
+	eq(t, d.Env["GOSH_WATCH_PARENT"], "1")
+	_, hasHome := d.Env["HOME"]
+	eq(t, hasHome, false)
+
+	// The description survives a JSON round trip.
+	b, err := json.Marshal(d)
+	ok(t, err)
+	var got gosh.CmdDescription
+	ok(t, json.Unmarshal(b, &got))
+	eq(t, got, d)
+}
+
+var (
+	sendVarsFunc = gosh.RegisterFunc("sendVarsFunc", func(vars map[string]string) {
+		gosh.SendVars(vars)
+		time.Sleep(time.Hour)
+	})
+	stderrFunc = gosh.RegisterFunc("stderrFunc", func(s string) {
+		fmt.Fprintf(os.Stderr, s)
+		time.Sleep(time.Hour)
+	})
+)
+
+// Tests that AwaitVars works under various conditions.
+func TestAwaitVars(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(sendVarsFunc, map[string]string{"a": "1"})
+	c.Start()
+	eq(t, c.AwaitVars("a")["a"], "1")
+
+	c = sh.FuncCmd(stderrFunc, `<goshVars{"a":"1","b":"2"}goshVars>`)
+	c.Start()
+	vars := c.AwaitVars("a", "b")
+	eq(t, vars["a"], "1")
+	eq(t, vars["b"], "2")
+
+	c = sh.FuncCmd(stderrFunc, `<goshVars{"a":"1"}goshVars><gosh`)
+	c.Start()
+	eq(t, c.AwaitVars("a")["a"], "1")
+
+	c = sh.FuncCmd(stderrFunc, `<goshVars{"a":"1"}goshVars><goshVars{"b":"2"}goshVars>`)
+	c.Start()
+	vars = c.AwaitVars("a", "b")
+	eq(t, vars["a"], "1")
+	eq(t, vars["b"], "2")
+
+	c = sh.FuncCmd(stderrFunc, `<goshVars{"a":"1","b":"2"}goshVars>`)
+	c.Start()
+	vars = c.AwaitVars("a")
+	eq(t, vars["a"], "1")
+	eq(t, vars["b"], "")
+	vars = c.AwaitVars("b")
+	eq(t, vars["a"], "")
+	eq(t, vars["b"], "2")
+
+	c = sh.FuncCmd(stderrFunc, `<g<goshVars{"a":"goshVars"}goshVars>s><goshVars`)
+	c.Start()
+	eq(t, c.AwaitVars("a")["a"], "goshVars")
+
+	c = sh.FuncCmd(stderrFunc, `<<goshVars{"a":"1"}goshVars>><<goshVars{"b":"<goshVars"}goshVars>>`)
+	c.Start()
+	vars = c.AwaitVars("a", "b")
+	eq(t, vars["a"], "1")
+	eq(t, vars["b"], "<goshVars")
+}
+
+// Tests that Shell.VarsTag changes the markers used by both SendVars and
+// AwaitVars.
+func TestVarsTag(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+	sh.VarsTag = "myVars"
+
+	c := sh.FuncCmd(sendVarsFunc, map[string]string{"a": "1"})
+	c.Start()
+	eq(t, c.AwaitVars("a")["a"], "1")
+
+	// Output using the default markers is not mistaken for vars.
+	c = sh.FuncCmd(stderrFunc, `<goshVars{"a":"1"}goshVars><myVars{"b":"2"}myVars>`)
+	c.Start()
+	vars := c.AwaitVars("b")
+	eq(t, vars["a"], "")
+	eq(t, vars["b"], "2")
+}
+
+var sendVarsConcurrentlyFunc = gosh.RegisterFunc("sendVarsConcurrentlyFunc", func(n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				fmt.Fprintf(os.Stderr, "<goshV%s\n", strings.Repeat("x", j))
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			gosh.SendVars(map[string]string{strconv.Itoa(i): strings.Repeat("y", 1<<12)})
+		}(i)
+	}
+	wg.Wait()
+})
+
+// Tests that vars sent concurrently with other stderr output are not corrupted.
+func TestSendVarsConcurrently(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	const n = 20
+	c := sh.FuncCmd(sendVarsConcurrentlyFunc, n)
+	c.Start()
+	var names []string
+	for i := 0; i < n; i++ {
+		names = append(names, strconv.Itoa(i))
+	}
+	vars := c.AwaitVars(names...)
+	for _, name := range names {
+		eq(t, vars[name], strings.Repeat("y", 1<<12))
+	}
+	c.Wait()
+}
+
+// sendVarsTwiceFunc sends a=1, then sends a=2 once it reads a byte from stdin.
+var sendVarsTwiceFunc = gosh.RegisterFunc("sendVarsTwiceFunc", func() error {
+	gosh.SendVars(map[string]string{"a": "1"})
+	if _, err := os.Stdin.Read(make([]byte, 1)); err != nil {
+		return err
+	}
+	gosh.SendVars(map[string]string{"a": "2"})
+	return nil
+})
+
+func TestReceivedVars(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(sendVarsTwiceFunc)
+	stdin := c.StdinPipe()
+	eq(t, c.ReceivedVars(), map[string]string{})
+	c.Start()
+	c.AwaitVars("a")
+	vars := c.ReceivedVars()
+	eq(t, vars, map[string]string{"a": "1"})
+	// The result is a copy.
+	vars["a"] = "x"
+	eq(t, c.ReceivedVars()["a"], "1")
+	stdin.Write([]byte("x"))
+	stdin.Close()
+	c.Wait()
+	eq(t, c.ReceivedVars(), map[string]string{"a": "2"})
+}
+
+func TestResetVars(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(sendVarsTwiceFunc)
+	stdin := c.StdinPipe()
+	c.Start()
+	eq(t, c.AwaitVars("a")["a"], "1")
+	// Without ResetVars, AwaitVars would return the stale value.
+	c.ResetVars()
+	stdin.Write([]byte("x"))
+	eq(t, c.AwaitVars("a")["a"], "2")
+	c.Wait()
+}
+
+// fakeClock is a Clock whose time never advances, and whose timers fire
+// immediately.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c fakeClock) Now() time.Time { return c.now }
+
+func (c fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func (c fakeClock) Sleep(d time.Duration) {}
+
+func TestClock(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	now := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	sh.Clock = fakeClock{now: now}
+
+	// Timestamps come from the clock.
+	var stdout bytes.Buffer
+	sh.PropagateChildOutput = true
+	sh.TimestampChildOutput = true
+	sh.Stdout = &stdout
+	sh.Cmd("echo", "a").Run()
+	eq(t, stdout.String(), now.Format(time.RFC3339Nano)+" a\n")
+
+	// Timeouts come from the clock, so this fails without waiting an hour.
+	sh.PropagateChildOutput = false
+	c := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Start()
+	setsErr(t, sh, func() {
+		c.AwaitHealthy(func() error { return fakeError }, time.Hour, time.Hour)
+	})
+	c.Terminate(os.Interrupt)
+}
+
+func TestAwaitHealthy(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Start()
+	calls := 0
+	c.AwaitHealthy(func() error {
+		if calls++; calls < 3 {
+			return fakeError
+		}
+		return nil
+	}, time.Minute, time.Millisecond)
+	eq(t, calls, 3)
+
+	// Fails if the timeout elapses.
+	failing := func() error { return fakeError }
+	setsErr(t, sh, func() { c.AwaitHealthy(failing, 100*time.Millisecond, time.Millisecond) })
+
+	// Fails early if the process exits.
+	c = sh.FuncCmd(exitFunc, 0)
+	c.Start()
+	start := time.Now()
+	setsErr(t, sh, func() { c.AwaitHealthy(failing, time.Hour, time.Millisecond) })
+	eq(t, time.Since(start) < time.Minute, true)
+}
+
+var listenFunc = gosh.RegisterFunc("listenFunc", func(addr string, delay time.Duration) error {
+	time.Sleep(delay)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	time.Sleep(time.Hour)
+	return nil
+})
+
+func TestAwaitListening(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Pick an unused address.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	ok(t, err)
+	addr := ln.Addr().String()
+	ok(t, ln.Close())
+
+	c := sh.FuncCmd(listenFunc, addr, 200*time.Millisecond)
+	c.Start()
+	c.AwaitListening(addr, time.Minute)
+	c.Terminate(os.Interrupt)
+
+	// Fails early if the process exits.
+	c = sh.FuncCmd(exitFunc, 0)
+	c.Start()
+	setsErr(t, sh, func() { c.AwaitListening(addr, time.Hour) })
+}
+
+func TestAwaitOutput(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Lines written to stdout or stderr are matched.
+	for _, redirect := range []string{"", ">&2"} {
+		c := sh.Cmd("sh", "-c", "echo starting; echo listening on 1234 "+redirect+"; exec sleep 3600")
+		c.Start()
+		c.AwaitOutput("listening", time.Minute)
+		c.Terminate(os.Interrupt)
+	}
+
+	// Lines written before AwaitOutput is called are matched, even if the
+	// process has since exited.
+	c := sh.Cmd("sh", "-c", "echo ready; exec sleep 3600")
+	c.Start()
+	c.AwaitOutput("ready", time.Minute)
+	c.AwaitOutput("ready", time.Minute)
+	c.Terminate(os.Interrupt)
+	c = sh.Cmd("sh", "-c", "echo ready")
+	c.Start()
+	for !c.Done() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.AwaitOutput("ready", time.Minute)
+	c.Wait()
+
+	// Only the most recent Cmd.OutputHistory bytes are retained.
+	c = sh.Cmd("sh", "-c", "echo ready; echo done")
+	c.OutputHistory = 5
+	c.Start()
+	for !c.Done() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.AwaitOutput("done", time.Minute)
+	setsErr(t, sh, func() { c.AwaitOutput("ready", time.Minute) })
+	c.Wait()
+
+	// Fails if the timeout elapses.
+	c = sh.Cmd("sleep", "3600")
+	c.Start()
+	setsErr(t, sh, func() { c.AwaitOutput("listening", 100*time.Millisecond) })
+	c.Terminate(os.Interrupt)
+
+	// Fails early if the process exits.
+	c = sh.Cmd("sh", "-c", "echo foo")
+	c.Start()
+	setsErr(t, sh, func() { c.AwaitOutput("bar", time.Hour) })
+	c.Wait()
+}
+
+func TestAwaitOutputRegexp(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.Cmd("sh", "-c", "echo listening on 127.0.0.1:8080; exec sleep 3600")
+	c.Start()
+	re := regexp.MustCompile(`listening on ([^:]+):(\d+)`)
+	eq(t, c.AwaitOutputRegexp(re, time.Minute), []string{"listening on 127.0.0.1:8080", "127.0.0.1", "8080"})
+	c.Terminate(os.Interrupt)
+
+	// Fails early if the process exits.
+	c = sh.Cmd("sh", "-c", "echo listening on 127.0.0.1")
+	c.Start()
+	setsErr(t, sh, func() { c.AwaitOutputRegexp(re, time.Hour) })
+	c.Wait()
+}
+
+// Tests that AwaitVars returns immediately when the process exits.
+func TestAwaitVarsProcessExit(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(exitFunc, 0)
+	c.Start()
+	setsErr(t, sh, func() { c.AwaitVars("foo") })
+}
+
+var announceListenersFunc = gosh.RegisterFunc("announceListenersFunc", func(names ...string) error {
+	lns := map[string]net.Listener{}
+	for _, name := range names {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		lns[name] = ln
+	}
+	return gosh.AnnounceListeners(lns)
+})
+
+func TestAwaitAddrs(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(announceListenersFunc, "http", "debug")
+	c.Start()
+	addrs := c.AwaitAddrs("http", "debug")
+	eq(t, len(addrs), 2)
+	for _, name := range []string{"http", "debug"} {
+		if !strings.HasPrefix(addrs[name], "127.0.0.1:") {
+			t.Errorf("got %q for %s, want a local address", addrs[name], name)
+		}
+	}
+	neq(t, addrs["http"], addrs["debug"])
+	c.Wait()
+
+	// Fails if the process exits without announcing all listeners.
+	c = sh.FuncCmd(announceListenersFunc, "http")
+	c.Start()
+	setsErr(t, sh, func() { c.AwaitAddrs("http", "debug") })
+}
+
+// Functions designed for TestRegistry.
+var (
 	printIntsFunc = gosh.RegisterFunc("printIntsFunc", func(v ...int) {
 		var vi []interface{}
 		for _, x := range v {
@@ -683,6 +2115,177 @@ func TestStdin(t *testing.T) {
 	setsErr(t, sh, func() { c.SetStdinReader(strings.NewReader("")) })
 }
 
+// Tests that SetStdinReader streams its input, rather than buffering it.
+func TestStdinReaderStreams(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// The child receives data, and echoes it back, before the reader returns
+	// EOF.
+	r, w := io.Pipe()
+	c := sh.Cmd("cat")
+	c.SetStdinReader(r)
+	stdout := bufio.NewReader(c.StdoutPipe())
+	c.Start()
+	_, err := w.Write([]byte("foo\n"))
+	ok(t, err)
+	line, err := stdout.ReadString('\n')
+	ok(t, err)
+	eq(t, line, "foo\n")
+	w.Close()
+	c.Wait()
+
+	// Files are read directly by the child.
+	f := sh.MakeTempFile()
+	_, err = f.WriteString("foo\n")
+	ok(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	ok(t, err)
+	c = sh.FuncCmd(catFunc)
+	c.SetStdinReader(f)
+	eq(t, c.Stdout(), "foo\n")
+}
+
+func TestInheritStdin(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	r, w, err := os.Pipe()
+	ok(t, err)
+	defer r.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	w.Write([]byte("foo"))
+	w.Close()
+
+	c := sh.FuncCmd(catFunc)
+	c.InheritStdin = true
+	eq(t, c.Stdout(), "foo")
+
+	// InheritStdin cannot be combined with other stdin sources.
+	c = sh.FuncCmd(catFunc)
+	c.InheritStdin = true
+	c.SetStdinReader(strings.NewReader("bar"))
+	setsErr(t, sh, func() { c.Start() })
+}
+
+func TestStdoutLines(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	collect := func(ch <-chan string) []string {
+		var res []string
+		for line := range ch {
+			res = append(res, line)
+		}
+		return res
+	}
+
+	// Lines are delivered without newlines; a trailing partial line is
+	// delivered at EOF.
+	c := sh.Cmd("sh", "-c", "printf 'a\\nb\\n'; printf 'c\\nd' >&2")
+	stdout, stderr := c.StdoutLines(), c.StderrLines()
+	c.Start()
+	eq(t, collect(stdout), []string{"a", "b"})
+	eq(t, collect(stderr), []string{"c", "d"})
+	c.Wait()
+	ok(t, c.LinesErr())
+
+	// Long lines are supported, up to a limit.
+	long := strings.Repeat("x", 1<<17)
+	c = sh.FuncCmd(catFunc)
+	c.SetStdinReader(strings.NewReader(long + "\n" + strings.Repeat("y", 2<<20) + "\nz\n"))
+	lines := c.StdoutLines()
+	c.Start()
+	eq(t, collect(lines), []string{long})
+	c.Wait()
+	nok(t, c.LinesErr())
+
+	// Must be called before Start.
+	c = sh.Cmd("true")
+	c.Run()
+	setsErr(t, sh, func() { c.StdoutLines() })
+}
+
+func TestMergeStderrIntoStdout(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// The child sees a single stream, and the output is exactly interleaved.
+	const script = `echo a; echo b >&2; echo c; [ /proc/self/fd/1 -ef /proc/self/fd/2 ] && echo same`
+	c := sh.Cmd("sh", "-c", script)
+	c.MergeStderrIntoStdout = true
+	want := "a\nb\nc\n"
+	if runtime.GOOS == "linux" {
+		want += "same\n"
+	}
+	eq(t, c.Stdout(), want)
+
+	// Vars are read from the merged stream.
+	c = sh.FuncCmd(sendVarsFunc, map[string]string{"a": "1"})
+	c.MergeStderrIntoStdout = true
+	c.Start()
+	eq(t, c.AwaitVars("a")["a"], "1")
+
+	// Stderr destinations are not allowed.
+	c = sh.Cmd("true")
+	c.MergeStderrIntoStdout = true
+	c.StderrPipe()
+	setsErr(t, sh, func() { c.Start() })
+	c = sh.Cmd("true")
+	c.MergeStderrIntoStdout = true
+	setsErr(t, sh, func() { c.TeeStderr(ioutil.Discard) })
+	c = sh.Cmd("true")
+	c.TeeStderr(ioutil.Discard)
+	c.MergeStderrIntoStdout = true
+	setsErr(t, sh, func() { c.Start() })
+
+	// No stderr file is created in OutputDir.
+	dir := sh.MakeTempDir()
+	c = sh.Cmd("sh", "-c", "echo a; echo b >&2")
+	c.MergeStderrIntoStdout = true
+	c.OutputDir = dir
+	c.Run()
+	matches, err := filepath.Glob(filepath.Join(dir, "*"))
+	ok(t, err)
+	eq(t, len(matches), 1)
+	eq(t, strings.HasSuffix(matches[0], ".stdout"), true)
+	eq(t, string(sh.ReadFile(matches[0])), "a\nb\n")
+}
+
+func TestPty(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("pty is only supported on linux")
+	}
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.Cmd("sh", "-c", "test -t 0 && test -t 1 && echo tty")
+	c.Pty = true
+	c.Start()
+	c.SetPtySize(24, 80)
+	// Reads from the pty fail with EIO once the child has exited.
+	b, _ := ioutil.ReadAll(c.PtyFile())
+	c.Wait()
+	eq(t, strings.TrimSpace(string(b)), "tty")
+	// Wait closes the pty.
+	_, err := c.PtyFile().Read(make([]byte, 1))
+	eq(t, errors.Is(err, os.ErrClosed), true)
+
+	// Pty cannot be combined with other stdout sources.
+	c = sh.Cmd("true")
+	c.Pty = true
+	c.AddStdoutWriter(ioutil.Discard)
+	setsErr(t, sh, func() { c.Start() })
+
+	// SetPtySize fails if the command has no pty.
+	c = sh.Cmd("true")
+	c.Start()
+	setsErr(t, sh, func() { c.SetPtySize(24, 80) })
+	c.Wait()
+}
+
 func TestStdinPipeWriteUntilExit(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
@@ -800,6 +2403,137 @@ func TestCombinedOutput(t *testing.T) {
 	eq(t, output, buf.String())
 }
 
+func TestOutputString(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	eq(t, sh.Cmd("echo", "foo").OutputString(), "foo")
+	// Only a single trailing newline is removed.
+	eq(t, sh.Cmd("printf", " foo \\n\\n").OutputString(), " foo \n")
+	eq(t, sh.Cmd("printf", "foo\\r\\n").OutputString(), "foo\r")
+	eq(t, sh.Cmd("printf", "foo").OutputString(), "foo")
+
+	eq(t, sh.Cmd("sh", "-c", "echo foo >&2").CombinedOutputString(), "foo")
+}
+
+func TestThenElse(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// "true && false || true" runs every command.
+	c0, c1, c2 := sh.Cmd("true"), sh.Cmd("false"), sh.Cmd("true")
+	eq(t, c0.Then(c1).Else(c2), c2)
+	ok(t, sh.Err)
+	eq(t, c1.ExitCode(), 1)
+	c2.Wait()
+	eq(t, c2.ExitCode(), 0)
+
+	// In "false && true && true", the failure of the first command skips the
+	// others, and is reported by Wait.
+	c0, c1, c2 = sh.Cmd("false"), sh.Cmd("true"), sh.Cmd("true")
+	c0.Then(c1).Then(c2)
+	ok(t, sh.Err)
+	eq(t, c1.Pid(), -1)
+	setsErr(t, sh, func() { c2.Wait() })
+	eq(t, c2.Pid(), -1)
+	var stageErr *gosh.StageError
+	eq(t, errors.As(c2.Err, &stageErr), true)
+	eq(t, stageErr.Cmd, c0)
+	eq(t, stageErr.Err, c0.Err)
+	eq(t, c0.ExitCode(), 1)
+	// Skipped commands cannot be started.
+	setsErr(t, sh, func() { c1.Start() })
+
+	// In "true || false && true", the skipped command passes on the success of
+	// the first.
+	c0, c1, c2 = sh.Cmd("true"), sh.Cmd("false"), sh.Cmd("true")
+	c0.Else(c1).Then(c2).Wait()
+	eq(t, c1.Pid(), -1)
+	eq(t, c2.ExitCode(), 0)
+
+	// A command that was already started is waited for.
+	c0, c1 = sh.Cmd("sh", "-c", "exit 2"), sh.Cmd("true")
+	c0.Start()
+	c0.Else(c1).Wait()
+	eq(t, c0.ExitCode(), 2)
+	eq(t, c1.ExitCode(), 0)
+
+	// Then fails for commands from another Shell.
+	sh2 := gosh.NewShell(t)
+	defer sh2.Cleanup()
+	setsErr(t, sh, func() { sh.Cmd("true").Then(sh2.Cmd("true")) })
+}
+
+func TestResult(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	res := sh.Cmd("sh", "-c", "echo out; echo err >&2; sleep 0.1").Result()
+	eq(t, res.Stdout, "out\n")
+	eq(t, res.Stderr, "err\n")
+	eq(t, res.ExitCode, 0)
+	eq(t, res.Signal, nil)
+	eq(t, res.Duration >= 100*time.Millisecond, true)
+	ok(t, res.Err)
+
+	// With ExitErrorIsOk, a failed run is described but not reported.
+	c := sh.Cmd("sh", "-c", "echo out; exit 3")
+	c.ExitErrorIsOk = true
+	res = c.Result()
+	eq(t, res.Stdout, "out\n")
+	eq(t, res.ExitCode, 3)
+	eq(t, res.Err, c.Err)
+	eq(t, res.Err.(*gosh.ExitError).ExitCode(), 3)
+
+	c = sh.Cmd("sh", "-c", "kill -TERM $$")
+	c.ExitErrorIsOk = true
+	res = c.Result()
+	eq(t, res.ExitCode, -1)
+	eq(t, res.Signal, syscall.SIGTERM)
+
+	// Otherwise, the failure is reported as usual.
+	setsErr(t, sh, func() { res = sh.Cmd("sh", "-c", "exit 1").Result() })
+	eq(t, res.ExitCode, 1)
+}
+
+var printReadPrintFunc = gosh.RegisterFunc("printReadPrintFunc", func() error {
+	fmt.Println("A")
+	if _, err := os.Stdin.Read(make([]byte, 1)); err != nil {
+		return err
+	}
+	fmt.Println("B")
+	return nil
+})
+
+func TestTeeStdout(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(printReadPrintFunc)
+	stdin, stdout := c.StdinPipe(), c.StdoutPipe()
+	c.Start()
+	// Wait for "A" to pass through the tee. AwaitOutput matches output written
+	// before it is called, and its matcher is fed by the tee, so this cannot miss
+	// "A" or return before the tee has seen it. Neither awaiting a var sent after
+	// printing "A" (stdout and stderr are copied independently) nor reading "A"
+	// from the stdout pipe (which is written before the tee) would suffice.
+	c.AwaitOutput("A", time.Minute)
+	// Only output written after TeeStdout is called is tee'd, and a failing
+	// writer does not affect the others.
+	var buf bytes.Buffer
+	c.TeeStdout(errorWriter{fakeError})
+	c.TeeStdout(&buf)
+	stdin.Write([]byte("x"))
+	c.Wait()
+	eq(t, buf.String(), "B\n")
+	got, err := ioutil.ReadAll(stdout)
+	ok(t, err)
+	eq(t, string(got), "A\nB\n")
+
+	// TeeStdout fails after Wait.
+	setsErr(t, sh, func() { c.TeeStdout(&buf) })
+}
+
 func TestOutputDir(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
@@ -809,14 +2543,16 @@ func TestOutputDir(t *testing.T) {
 	c.OutputDir = dir
 	c.Run()
 
-	matches, err := filepath.Glob(filepath.Join(dir, "*.stdout"))
+	// File names include the PID.
+	pattern := fmt.Sprintf("%s.%d.*", filepath.Base(c.Path), c.Pid())
+	matches, err := filepath.Glob(filepath.Join(dir, pattern+".stdout"))
 	ok(t, err)
 	eq(t, len(matches), 1)
 	stdout, err := ioutil.ReadFile(matches[0])
 	ok(t, err)
 	eq(t, string(stdout), "AA")
 
-	matches, err = filepath.Glob(filepath.Join(dir, "*.stderr"))
+	matches, err = filepath.Glob(filepath.Join(dir, pattern+".stderr"))
 	ok(t, err)
 	eq(t, len(matches), 1)
 	stderr, err := ioutil.ReadFile(matches[0])
@@ -824,6 +2560,275 @@ func TestOutputDir(t *testing.T) {
 	eq(t, string(stderr), "BB")
 }
 
+// Tests that commands started concurrently with the same timestamp, by
+// different Shells, write to distinct output files.
+func TestOutputDirConcurrentStarts(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	dir := sh.MakeTempDir()
+	cmds := make([]*gosh.Cmd, 10)
+	for i := range cmds {
+		sh := gosh.NewShell(t)
+		defer sh.Cleanup()
+		sh.Clock = fakeClock{now: time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)}
+		cmds[i] = sh.Cmd("echo", strconv.Itoa(i))
+		cmds[i].OutputDir = dir
+	}
+	var wg sync.WaitGroup
+	for _, c := range cmds {
+		wg.Add(1)
+		go func(c *gosh.Cmd) {
+			defer wg.Done()
+			c.Start()
+		}(c)
+	}
+	wg.Wait()
+	for i, c := range cmds {
+		c.Wait()
+		pattern := fmt.Sprintf("echo.%d.20150102.030405.000000.stdout", c.Pid())
+		eq(t, string(sh.ReadFile(filepath.Join(dir, pattern))), strconv.Itoa(i)+"\n")
+	}
+}
+
+// Tests that output directories are created if they don't exist.
+func TestOutputDirCreated(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	dir := filepath.Join(sh.MakeTempDir(), "a", "b")
+	sh.ChildOutputDir = dir
+	sh.FuncCmd(writeFunc, true, true).Run()
+	matches, err := filepath.Glob(filepath.Join(dir, "*.stdout"))
+	ok(t, err)
+	eq(t, len(matches), 1)
+
+	dir = filepath.Join(sh.MakeTempDir(), "c", "d")
+	sh.ChildOutputDir = ""
+	c := sh.FuncCmd(writeFunc, true, true)
+	c.OutputDir = dir
+	c.Run()
+	matches, err = filepath.Glob(filepath.Join(dir, "*.stderr"))
+	ok(t, err)
+	eq(t, len(matches), 1)
+}
+
+func TestChildOutputDirPerRun(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	dir := sh.MakeTempDir()
+	for _, name := range []string{"20200101.000000.000000.1", "20200102.000000.000000.1", "20200103.000000.000000.1", "other"} {
+		ok(t, os.Mkdir(filepath.Join(dir, name), 0700))
+	}
+	sh.ChildOutputDir = dir
+	sh.ChildOutputDirPerRun = true
+	sh.MaxChildOutputRuns = 2
+	sh.FuncCmd(writeFunc, true, true).Run()
+	sh.FuncCmd(writeFunc, true, true).Run()
+
+	// Output is written to a new subdirectory, and the oldest subdirectories
+	// are pruned. Other files are left alone.
+	infos, err := ioutil.ReadDir(dir)
+	ok(t, err)
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	eq(t, len(names), 3)
+	eq(t, names[0], "20200103.000000.000000.1")
+	eq(t, names[2], "other")
+	matches, err := filepath.Glob(filepath.Join(dir, names[1], "*.stdout"))
+	ok(t, err)
+	eq(t, len(matches), 2)
+}
+
+func TestCompressChildOutput(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	readGzip := func(pattern string) string {
+		matches, err := filepath.Glob(pattern)
+		ok(t, err)
+		eq(t, len(matches), 1)
+		f, err := os.Open(matches[0])
+		ok(t, err)
+		defer f.Close()
+		r, err := gzip.NewReader(f)
+		ok(t, err)
+		b, err := ioutil.ReadAll(r)
+		ok(t, err)
+		return string(b)
+	}
+
+	dir := sh.MakeTempDir()
+	sh.ChildOutputDir = dir
+	sh.CompressChildOutput = true
+	sh.FuncCmd(writeFunc, true, true).Run()
+	eq(t, readGzip(filepath.Join(dir, "*.stdout.gz")), "AA")
+	eq(t, readGzip(filepath.Join(dir, "*.stderr.gz")), "BB")
+
+	// The files are complete even if the child is killed by Cleanup.
+	dir = sh.MakeTempDir()
+	sh2 := gosh.NewShell(t)
+	sh2.ChildOutputDir = dir
+	sh2.CompressChildOutput = true
+	sh2.AllowUnwaitedCmds = true
+	c := sh2.Cmd("sh", "-c", "echo hi; exec sleep 3600")
+	c.Start()
+	c.AwaitOutput("hi", time.Minute)
+	sh2.Cleanup()
+	eq(t, readGzip(filepath.Join(dir, "*.stdout.gz")), "hi\n")
+}
+
+func TestMaxRunningCmds(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	sh.MaxRunningCmds = 1
+	c1 := sh.Cmd("sleep", "3600")
+	c1.Start()
+	// Start blocks until the running command exits.
+	c2 := sh.Cmd("true")
+	started := make(chan struct{})
+	go func() {
+		c2.Start()
+		close(started)
+	}()
+	select {
+	case <-started:
+		t.Fatal("Start did not block")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Note, the Shell must not be used concurrently with c2.Start.
+	ok(t, syscall.Kill(c1.Pid(), syscall.SIGKILL))
+	<-started
+	c2.Wait()
+	setsErr(t, sh, func() { c1.Wait() })
+
+	// Commands that fail to start do not hold a slot.
+	sh.ContinueOnError = true
+	c3 := sh.Cmd("true")
+	c3.Nice = 20
+	c3.Start()
+	nok(t, sh.Err)
+	sh.Err = nil
+	sh.Cmd("true").Run()
+	ok(t, sh.Err)
+
+	// Commands run internally by gosh are not counted, so they don't wait for
+	// user commands to exit.
+	sh.ContinueOnError = false
+	c4 := sh.Cmd("sleep", "3600")
+	c4.Start()
+	eq(t, sh.CallInChild(squareFunc, 7), 49)
+	c4.Terminate(os.Kill)
+}
+
+func TestStats(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	eq(t, sh.Stats(), gosh.ShellStats{})
+	sh.Cmd("true").Run()
+	c := sh.Cmd("false")
+	c.ExitErrorIsOk = true
+	c.Run()
+	c = sh.Cmd("sleep", "3600")
+	c.Start()
+	eq(t, sh.Stats(), gosh.ShellStats{CmdsStarted: 3, CmdsSucceeded: 1, CmdsFailed: 1, CmdsRunning: 1})
+	c.Terminate(os.Kill)
+	eq(t, sh.Stats().CmdsRunning, 0)
+	eq(t, sh.Stats().CmdsFailed, 2)
+}
+
+func TestShellStdoutStderr(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	var stdout, stderr bytes.Buffer
+	sh.PropagateChildOutput = true
+	sh.Stdout, sh.Stderr = &stdout, &stderr
+	sh.FuncCmd(writeFunc, true, true).Run()
+	eq(t, stdout.String(), "AA")
+	eq(t, stderr.String(), "BB")
+}
+
+// Tests that contradictory or invalid Shell configuration is reported when a
+// command is created.
+func TestShellConfig(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	sh.PropagateChildOutput = true
+	sh.LogChildOutput = true
+	sh.Stdout = &bytes.Buffer{}
+	setsErr(t, sh, func() { sh.Cmd("true") })
+	setsErr(t, sh, func() { sh.FuncCmd(exitFunc, 0) })
+	sh.LogChildOutput = false
+	sh.Cmd("true")
+	// The conflict only matters if child output is propagated.
+	sh.LogChildOutput, sh.PropagateChildOutput = true, false
+	sh.Cmd("true")
+
+	sh.ChildOutputDir = filepath.Join(sh.MakeTempFile().Name(), "dir")
+	setsErr(t, sh, func() { sh.Cmd("true") })
+	setsErr(t, sh, func() { sh.Adopt(exec.Command("true")) })
+}
+
+func TestManifest(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	sh.ManifestPath = filepath.Join(sh.MakeTempDir(), "manifest")
+	c := sh.FuncCmd(exitFunc, 1)
+	c.ExitErrorIsOk = true
+	c.Run()
+	c = sh.Cmd("sh", "-c", "echo a")
+	c.OutputDir = sh.MakeTempDir()
+	c.Run()
+
+	lines := strings.Split(strings.TrimSpace(string(sh.ReadFile(sh.ManifestPath))), "\n")
+	eq(t, len(lines), 2)
+	var entries [2]gosh.ManifestEntry
+	for i, line := range lines {
+		ok(t, json.Unmarshal([]byte(line), &entries[i]))
+	}
+	eq(t, entries[0].FuncName, "exitFunc")
+	eq(t, entries[0].FuncArgs, []interface{}{float64(1)})
+	eq(t, entries[0].ExitCode, 1)
+	eq(t, entries[1].Args[1:], []string{"-c", "echo a"})
+	eq(t, entries[1].ExitCode, 0)
+	eq(t, len(entries[1].OutputFiles), 2)
+	eq(t, string(sh.ReadFile(entries[1].OutputFiles[0])), "a\n")
+}
+
+func TestLogChildOutput(t *testing.T) {
+	tb := &customTB{t: t, buf: &bytes.Buffer{}}
+	sh := gosh.NewShell(tb)
+	defer sh.Cleanup()
+
+	sh.PropagateChildOutput = true
+	sh.LogChildOutput = true
+	sh.Cmd("sh", "-c", "echo a; echo b >&2; printf c").Run()
+	logs := tb.buf.String()
+	for _, want := range []string{"INFO sh: a\n", "WARN sh: b\n", "INFO sh: c\n"} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("got %q, want it to contain %q", logs, want)
+		}
+	}
+
+	// Log lines compose with timestamps.
+	tb.Reset()
+	sh.TimestampChildOutput = true
+	sh.Cmd("sh", "-c", "echo a").Run()
+	parts := strings.SplitN(strings.TrimPrefix(tb.buf.String(), "INFO sh: "), " ", 2)
+	eq(t, len(parts), 2)
+	_, err := time.Parse(time.RFC3339Nano, parts[0])
+	ok(t, err)
+	eq(t, parts[1], "a\n")
+}
+
 var replaceFunc = gosh.RegisterFunc("replaceFunc", func(old, new byte) error {
 	buf := make([]byte, 1024)
 	for {
@@ -839,7 +2844,59 @@ var replaceFunc = gosh.RegisterFunc("replaceFunc", func(old, new byte) error {
 			return err
 		}
 	}
-})
+})
+
+func TestDone(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	eq(t, c.Done(), false)
+	c.Start()
+	c.AwaitVars("ready")
+	eq(t, c.Done(), false)
+	c.Signal(os.Interrupt)
+	<-c.WaitCh()
+	eq(t, c.Done(), true)
+}
+
+// Tests that signaling a process that has already exited deterministically
+// stores ErrProcessExited, without reporting it to the Shell.
+func TestSignalExited(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(exitFunc, 0)
+	c.Start()
+	for !c.Done() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Signal(os.Interrupt)
+	ok(t, sh.Err)
+	eq(t, c.Err, gosh.ErrProcessExited)
+	c.Terminate(os.Interrupt)
+	ok(t, c.Err)
+}
+
+func TestInterrupt(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Start()
+	c.AwaitVars("ready")
+	c.Interrupt()
+	c.Wait()
+	// Interrupting an exited process stores ErrProcessExited.
+	c = sh.FuncCmd(exitFunc, 0)
+	c.Start()
+	for !c.Done() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Interrupt()
+	ok(t, sh.Err)
+	eq(t, c.Err, gosh.ErrProcessExited)
+}
 
 func TestSignal(t *testing.T) {
 	sh := gosh.NewShell(t)
@@ -851,17 +2908,19 @@ func TestSignal(t *testing.T) {
 			c := sh.FuncCmd(sleepFunc, d, 0)
 			c.Start()
 			c.AwaitVars("ready")
-			// Wait for a bit to allow the zero-sleep commands to exit.
-			time.Sleep(100 * time.Millisecond)
+			if d == 0 {
+				// Wait for the zero-sleep commands to exit.
+				for !c.Done() {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
 			c.Signal(s)
 			switch {
-			case s == os.Interrupt:
+			case s == os.Interrupt || d == 0:
 				// Wait should succeed as long as the exit code was 0, regardless of
 				// whether the signal arrived or the process had already exited.
 				c.Wait()
-			case d != 0:
-				// Note: We don't call Wait in the {d: 0, s: os.Kill} case because doing
-				// so makes the test flaky on slow systems.
+			default:
 				setsErr(t, sh, func() { c.Wait() })
 			}
 		}
@@ -903,6 +2962,85 @@ func TestCleanupProcessGroup(t *testing.T) {
 	}
 }
 
+var multipleShellsFunc = gosh.RegisterFunc("multipleShellsFunc", func(n int) {
+	pids := make([]string, n)
+	for x := 0; x < n; x++ {
+		sh := gosh.NewShell(nil)
+		defer sh.Cleanup()
+		c := sh.Cmd("sleep", "3600")
+		c.Start()
+		pids[x] = strconv.Itoa(c.Pid())
+	}
+	gosh.SendVars(map[string]string{"pids": strings.Join(pids, ",")})
+	time.Sleep(time.Minute)
+})
+
+var parentDeathFunc = gosh.RegisterFunc("parentDeathFunc", func(disable bool) {
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+	sh.DisableParentDeathSignal = disable
+	c := sh.Cmd("sleep", "3600")
+	c.Start()
+	gosh.SendVars(map[string]string{"pid": strconv.Itoa(c.Pid())})
+	time.Sleep(time.Minute)
+})
+
+// isRunning returns true if the process with the given pid exists and is not a
+// zombie.
+func isRunning(pid int) bool {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The state is the first field after the parenthesized command name.
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return fields[0] != "Z"
+}
+
+func TestParentDeathSignal(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("parent death signals are only supported on linux")
+	}
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	for _, disable := range []bool{false, true} {
+		// Kill the child without giving it a chance to clean up. The grandchild,
+		// which does not watch its parent, is killed by the kernel unless the
+		// parent death signal was disabled.
+		c := sh.FuncCmd(parentDeathFunc, disable)
+		c.Start()
+		pid, err := strconv.Atoi(c.AwaitVars("pid")["pid"])
+		ok(t, err)
+		c.Signal(os.Kill)
+		setsErr(t, sh, func() { c.Wait() })
+		running := true
+		for i := 0; i < 100 && running; i++ {
+			time.Sleep(10 * time.Millisecond)
+			running = isRunning(pid)
+		}
+		eq(t, running, disable)
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+func TestCleanupMultipleShellsOnSignal(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Upon receiving a termination signal, the child should clean up the children
+	// of all of its Shells before exiting.
+	c := sh.FuncCmd(multipleShellsFunc, 3)
+	c.Start()
+	pids := c.AwaitVars("pids")["pids"]
+	c.Signal(os.Interrupt)
+	setsErr(t, sh, func() { c.Wait() })
+	for _, pid := range strings.Split(pids, ",") {
+		p, _ := strconv.Atoi(pid)
+		eq(t, syscall.Kill(p, 0), syscall.ESRCH)
+	}
+}
+
 func TestTerminate(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
@@ -927,6 +3065,217 @@ func TestTerminate(t *testing.T) {
 	setsErr(t, sh, func() { c.Terminate(os.Interrupt) })
 }
 
+// Tests that Cleanup closes the pipes of commands that were not waited for, so
+// that readers see EOF.
+func TestCleanupClosesPipes(t *testing.T) {
+	sh := gosh.NewShell(t)
+	sh.AllowUnwaitedCmds = true
+
+	c := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	stdout := c.StdoutPipe()
+	c.Start()
+	c.AwaitVars("ready")
+	sh.Cleanup()
+	done := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(stdout)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		ok(t, err)
+	case <-time.After(time.Minute):
+		t.Fatal("timed out")
+	}
+}
+
+func TestSetStdoutStderrFile(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	stdout, stderr := sh.MakeTempFile(), sh.MakeTempFile()
+	c := sh.FuncCmd(writeFunc, true, true)
+	c.SetStdoutFile(stdout)
+	c.SetStderrFile(stderr)
+	c.Run()
+	eq(t, string(sh.ReadFile(stdout.Name())), "AA")
+	eq(t, string(sh.ReadFile(stderr.Name())), "BB")
+
+	// AwaitVars is not supported if stderr is a file.
+	c = sh.FuncCmd(sendVarsFunc, map[string]string{"a": "1"})
+	c.SetStderrFile(stderr)
+	c.Start()
+	setsErr(t, sh, func() { c.AwaitVars("a") })
+	c.Terminate(os.Interrupt)
+
+	// A file cannot be combined with pipes or writers for the same stream, in
+	// either order.
+	c = sh.FuncCmd(writeFunc, true, true)
+	c.StdoutPipe()
+	setsErr(t, sh, func() { c.SetStdoutFile(stdout) })
+	c = sh.FuncCmd(writeFunc, true, true)
+	c.SetStdoutFile(stdout)
+	setsErr(t, sh, func() { c.Stdout() })
+	// But the other stream may still be captured.
+	c = sh.FuncCmd(writeFunc, true, true)
+	c.SetStdoutFile(stdout)
+	stderrPipe := c.StderrPipe()
+	c.Run()
+	b, err := ioutil.ReadAll(stderrPipe)
+	ok(t, err)
+	eq(t, string(b), "BB")
+}
+
+// Tests that pipes are closed when the process exits, even if Wait is never
+// called.
+func TestPipesClosedWithoutWait(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(writeFunc, true, true)
+	stdout, stderr := c.StdoutPipe(), c.StderrPipe()
+	c.Start()
+	done := make(chan error, 2)
+	for _, r := range []io.Reader{stdout, stderr} {
+		go func(r io.Reader) {
+			_, err := ioutil.ReadAll(r)
+			done <- err
+		}(r)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			ok(t, err)
+		case <-time.After(time.Minute):
+			t.Fatal("timed out")
+		}
+	}
+}
+
+// Tests that Wait may be called multiple times, returning the same result.
+func TestWaitTwice(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(exitFunc, 0)
+	c.Start()
+	c.Wait()
+	c.Wait()
+	ok(t, c.Err)
+
+	c = sh.FuncCmd(exitFunc, 1)
+	c.Start()
+	setsErr(t, sh, func() { c.Wait() })
+	setsErr(t, sh, func() { c.Wait() })
+	// Signal still fails once Wait has been called.
+	setsErr(t, sh, func() { c.Signal(os.Interrupt) })
+}
+
+func TestWaitCh(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// WaitCh should fail if Start has not been called.
+	c := sh.FuncCmd(exitFunc, 0)
+	setsErr(t, sh, func() { c.WaitCh() })
+
+	// Exit code 0.
+	c.Start()
+	ch := c.WaitCh()
+	ok(t, <-ch)
+	ok(t, c.Err)
+	// The channel is closed after delivering the error.
+	if _, open := <-ch; open {
+		t.Fatal("channel not closed")
+	}
+	// WaitCh should fail if WaitCh has been called, whereas Wait returns the
+	// result delivered on the channel.
+	setsErr(t, sh, func() { c.WaitCh() })
+	c.Wait()
+	ok(t, sh.Err)
+
+	// Exit code 1 is delivered on the channel, but not reported to the Shell.
+	c = sh.FuncCmd(exitFunc, 1)
+	c.Start()
+	select {
+	case err := <-c.WaitCh():
+		nok(t, err)
+		nok(t, c.Err)
+	case <-time.After(time.Minute):
+		t.Fatal("timed out")
+	}
+	ok(t, sh.Err)
+}
+
+func TestRestart(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Restarting a running command.
+	c := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Start()
+	c.AwaitVars("ready")
+	c2 := c.Restart()
+	neq(t, c2.Pid(), c.Pid())
+	c2.AwaitVars("ready")
+
+	// Restarting an exited command.
+	c = sh.FuncCmd(exitFunc, 0)
+	c.Run()
+	c2 = c.Restart()
+	c2.Wait()
+	eq(t, c2.ExitCode(), 0)
+}
+
+func TestExitCodeSignaled(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Not yet exited.
+	c := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	eq(t, c.ExitCode(), -1)
+	c.Start()
+	c.AwaitVars("ready")
+	sig, signaled := c.Signaled()
+	eq(t, sig, nil)
+	eq(t, signaled, false)
+
+	// Terminated by a signal.
+	c.Terminate(os.Kill)
+	eq(t, c.ExitCode(), -1)
+	sig, signaled = c.Signaled()
+	eq(t, sig, os.Kill)
+	eq(t, signaled, true)
+
+	// Exited normally.
+	c = sh.FuncCmd(exitFunc, 2)
+	c.ExitErrorIsOk = true
+	c.Run()
+	eq(t, c.ExitCode(), 2)
+	sig, signaled = c.Signaled()
+	eq(t, sig, nil)
+	eq(t, signaled, false)
+}
+
+func TestSuccess(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	eq(t, sh.FuncCmd(exitFunc, 0).Success(), true)
+	ok(t, sh.Err)
+
+	// A non-zero exit code is not reported to the Shell.
+	c := sh.FuncCmd(exitFunc, 1)
+	eq(t, c.Success(), false)
+	nok(t, c.Err)
+	ok(t, sh.Err)
+
+	// Other errors are reported to the Shell.
+	c = sh.FuncCmd(exitFunc, 0)
+	c.Run()
+	setsErr(t, sh, func() { c.Success() })
+}
+
 func TestExitErrorIsOk(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
@@ -981,6 +3330,17 @@ var writeLoopFunc = gosh.RegisterFunc("writeLoopFunc", func() error {
 	}
 })
 
+var writeLoopExitFunc = gosh.RegisterFunc("writeLoopExitFunc", func() error {
+	// Like many non-Go programs, exit with a non-zero exit code (rather than
+	// dying from SIGPIPE) upon failing to write to a closed pipe.
+	signal.Ignore(syscall.SIGPIPE)
+	for {
+		if _, err := os.Stdout.Write([]byte("a\n")); err != nil {
+			return err
+		}
+	}
+})
+
 type errorWriter struct {
 	error
 }
@@ -1129,3 +3489,277 @@ func TestBuildGoPkg(t *testing.T) {
 	c = sh.Cmd(absName)
 	eq(t, c.Stdout(), helloWorldStr)
 }
+
+// Tests that Shell.Args are not passed to "go build".
+func TestBuildGoPkgShellArgs(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	sh.Args = []string{"-not-a-go-flag", "not/a/package"}
+	binPath := gosh.BuildGoPkg(sh, sh.MakeTempDir(), helloWorldPkg)
+	sh.Args = nil
+	eq(t, sh.Cmd(binPath).Stdout(), helloWorldStr)
+}
+
+// Tests that BuildGoPkgInfo reports whether the binary was rebuilt and how long
+// the build took, and that only actual builds are counted in Shell.Stats.
+func TestBuildGoPkgInfo(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	binDir := sh.MakeTempDir()
+	res := gosh.BuildGoPkgInfo(sh, binDir, helloWorldPkg)
+	eq(t, res.Rebuilt, true)
+	eq(t, res.Duration > 0, true)
+	eq(t, sh.Cmd(res.BinPath).Stdout(), helloWorldStr)
+
+	// The second build hits the cache.
+	res2 := gosh.BuildGoPkgInfo(sh, binDir, helloWorldPkg)
+	eq(t, res2.BinPath, res.BinPath)
+	eq(t, res2.Rebuilt, false)
+
+	// Only the first build is counted.
+	stats := sh.Stats()
+	eq(t, stats.Builds, 1)
+	eq(t, stats.BuildTime, res.Duration)
+}
+
+// Tests that BuildGoTestPkg builds a test binary distinct from the package's
+// binary, and honors -o.
+func TestBuildGoTestPkg(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	binDir := sh.MakeTempDir()
+	testBinPath := gosh.BuildGoTestPkg(sh, binDir, helloWorldPkg)
+	binPath := gosh.BuildGoPkg(sh, binDir, helloWorldPkg)
+	neq(t, testBinPath, binPath)
+	eq(t, sh.Cmd(binPath).Stdout(), helloWorldStr)
+	stdout := sh.Cmd(testBinPath, "-test.run=TestHelloWorld", "-test.v").Stdout()
+	if !strings.Contains(stdout, "Hello, test!") {
+		t.Fatalf("got %q, want it to contain %q", stdout, "Hello, test!")
+	}
+
+	// Set -o, and check that the binary is not rebuilt.
+	absName := filepath.Join(sh.MakeTempDir(), "hw.test")
+	eq(t, gosh.BuildGoTestPkg(sh, "", helloWorldPkg, "-o", absName), absName)
+	eq(t, gosh.BuildGoTestPkg(sh, "", helloWorldPkg, "-o", absName), absName)
+}
+
+// Tests that BuildGoPkg runs the go command named by Shell.GoBinary.
+func TestBuildGoPkgGoBinary(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+	eq(t, sh.GoBinary, "go")
+
+	// Use a wrapper script that records its invocation, then runs the real go.
+	dir := sh.MakeTempDir()
+	marker := filepath.Join(dir, "marker")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s\nexec %s \"$@\"\n", marker, sh.LookPath("go"))
+	ok(t, ioutil.WriteFile(filepath.Join(dir, "mygo"), []byte(script), 0700))
+	sh.Vars["PATH"] = dir + string(filepath.ListSeparator) + os.Getenv("PATH")
+	sh.GoBinary = "mygo"
+	binPath := gosh.BuildGoPkg(sh, sh.MakeTempDir(), helloWorldPkg)
+	eq(t, sh.Cmd(binPath).Stdout(), helloWorldStr)
+	args, err := ioutil.ReadFile(marker)
+	ok(t, err)
+	if !strings.HasPrefix(string(args), "build ") {
+		t.Fatalf("got %q, want prefix %q", args, "build ")
+	}
+}
+
+// Tests that BuildGoPkg gives distinct names to binaries for distinct packages
+// with the same base name.
+func TestBuildGoPkgSameBaseName(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	binDir := sh.MakeTempDir()
+	aPath := gosh.BuildGoPkg(sh, binDir, "github.com/asadovsky/gosh/internal/samename/a/server")
+	bPath := gosh.BuildGoPkg(sh, binDir, "github.com/asadovsky/gosh/internal/samename/b/server")
+	neq(t, aPath, bPath)
+	eq(t, filepath.Dir(aPath), binDir)
+	eq(t, filepath.Dir(bPath), binDir)
+	if !strings.HasPrefix(filepath.Base(aPath), "server") {
+		t.Fatalf("got %v, want prefix server", filepath.Base(aPath))
+	}
+	eq(t, sh.Cmd(aPath).Stdout(), "a\n")
+	eq(t, sh.Cmd(bPath).Stdout(), "b\n")
+
+	// Shell.BinName overrides the default naming scheme.
+	sh.BinName = func(pkg string) string { return "custom" }
+	eq(t, gosh.BuildGoPkg(sh, binDir, helloWorldPkg), filepath.Join(binDir, "custom"))
+	eq(t, sh.Cmd(filepath.Join(binDir, "custom")).Stdout(), helloWorldStr)
+}
+
+func TestSSHBackend(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Use a fake ssh client that records its args, then runs the remote command
+	// line locally, in a new session, as sshd would.
+	dir := sh.MakeTempDir()
+	marker := filepath.Join(dir, "marker")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s\nwhile [ \"$1\" != -- ]; do shift; done\nsetsid sh -c \"$3\"\n", marker)
+	fakeSSH := filepath.Join(dir, "fakessh")
+	ok(t, ioutil.WriteFile(fakeSSH, []byte(script), 0700))
+	sh.Backend = gosh.NewSSHBackend("example.com", gosh.SSHConfig{Binary: fakeSSH, User: "alice", Port: 2222})
+
+	// Vars, args, stdout, and stderr are passed through.
+	c := sh.Cmd("sh", "-c", `echo "$A" "$1"; echo err >&2`, "sh", "x y")
+	c.Vars["A"] = "a'b"
+	stdout, stderr := c.StdoutStderr()
+	eq(t, stdout, "a'b x y\n")
+	eq(t, stderr, "err\n")
+	args, err := ioutil.ReadFile(marker)
+	ok(t, err)
+	if !strings.HasPrefix(string(args), "-T -l alice -p 2222 -- example.com ") {
+		t.Errorf("unexpected ssh args: %s", args)
+	}
+
+	// The control protocol works, given the same binary on the "remote" host.
+	c = sh.FuncCmd(sendVarsFunc, map[string]string{"a": "1"})
+	c.Start()
+	eq(t, c.AwaitVars("a")["a"], "1")
+
+	// Names are not resolved locally.
+	c = sh.Cmd("gosh-no-such-executable")
+	setsErr(t, sh, func() { c.Run() })
+	eq(t, c.ExitCode(), 127)
+
+	// Killing the ssh client kills the remote command.
+	pidFile := filepath.Join(dir, "pid")
+	c = sh.Cmd("sh", "-c", `echo $$ > `+pidFile+`; echo ready; exec sleep 3600`)
+	c.Start()
+	c.AwaitOutput("ready", time.Minute)
+	b, err := ioutil.ReadFile(pidFile)
+	ok(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	ok(t, err)
+	c.Signal(os.Kill)
+	setsErr(t, sh, c.Wait)
+	for deadline := time.Now().Add(time.Minute); syscall.Kill(pid, 0) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("remote command was not killed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Invocations passed via a local file are rejected.
+	c = sh.FuncCmd(lenFunc, strings.Repeat("a", 1<<16))
+	setsErr(t, sh, c.Start)
+
+	// Builds run locally.
+	sh.Backend = gosh.NewSSHBackend("example.com", gosh.SSHConfig{Binary: filepath.Join(dir, "gosh-no-such-executable")})
+	binPath := gosh.BuildGoPkg(sh, sh.MakeTempDir(), helloWorldPkg)
+	ok(t, sh.Err)
+	eq(t, filepath.IsAbs(binPath), true)
+}
+
+func TestFakeRunner(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+	r := gosh.NewFakeRunner()
+	r.Results["echo foo"] = gosh.FakeResult{Stdout: "fake foo\n", Stderr: "fake err\n"}
+	r.Results["false"] = gosh.FakeResult{ExitCode: 3}
+	r.Results["sleep 60"] = gosh.FakeResult{Running: true}
+	sh.Runner = r
+
+	// Canned output is returned.
+	stdout, stderr := sh.Cmd("echo", "foo").StdoutStderr()
+	eq(t, stdout, "fake foo\n")
+	eq(t, stderr, "fake err\n")
+	// Commands not found in Results get Default.
+	eq(t, sh.Cmd("echo", "bar").Stdout(), "")
+
+	// Canned exit codes are returned.
+	c := sh.Cmd("false")
+	setsErr(t, sh, func() { c.Run() })
+	eq(t, c.ExitCode(), 3)
+	c = sh.Cmd("false")
+	c.ExitErrorIsOk = true
+	c.Run()
+	ok(t, sh.Err)
+
+	// Running commands exit when signaled.
+	c = sh.Cmd("sleep", "60")
+	c.Start()
+	eq(t, c.Done(), false)
+	c.Terminate(os.Interrupt)
+	sig, signaled := c.Signaled()
+	eq(t, signaled, true)
+	eq(t, sig, os.Interrupt)
+
+	// Vars sent by fake commands are received.
+	r.Results["sh -c fake"] = gosh.FakeResult{Stderr: `<goshVars{"a":"1"}goshVars>`}
+	c = sh.Cmd("sh", "-c", "fake")
+	c.Start()
+	eq(t, c.AwaitVars("a")["a"], "1")
+	c.Wait()
+
+	eq(t, r.CmdLines(), []string{"echo foo", "echo bar", "false", "false", "sleep 60", "sh -c fake"})
+
+	// Builds don't use the Runner.
+	binPath := gosh.BuildGoPkg(sh, sh.MakeTempDir(), helloWorldPkg)
+	sh.Runner = nil
+	eq(t, sh.Cmd(binPath).Stdout(), helloWorldStr)
+}
+
+func TestDockerBackend(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Use a fake docker client that records its args, then runs the command
+	// locally, applying the env and working dir.
+	dir := sh.MakeTempDir()
+	marker := filepath.Join(dir, "marker")
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$@" > %s
+shift 2
+while true; do
+  case "$1" in
+    -e) export "$2"; shift 2;;
+    -w) cd "$2"; shift 2;;
+    -u) shift 2;;
+    *) break;;
+  esac
+done
+shift
+exec "$@"
+`, marker)
+	fakeDocker := filepath.Join(dir, "fakedocker")
+	ok(t, ioutil.WriteFile(fakeDocker, []byte(script), 0700))
+	sh.Backend = gosh.NewDockerBackend("mycontainer", gosh.DockerConfig{Binary: fakeDocker, User: "alice"})
+
+	// Vars, args, stdout, and stderr are passed through.
+	c := sh.Cmd("sh", "-c", `echo "$A" "$1"; echo err >&2`, "sh", "x y")
+	c.Vars["A"] = "a b"
+	stdout, stderr := c.StdoutStderr()
+	eq(t, stdout, "a b x y\n")
+	eq(t, stderr, "err\n")
+	args, err := ioutil.ReadFile(marker)
+	ok(t, err)
+	if !strings.HasPrefix(string(args), "exec -i -u alice -e A=a b -e GOSH_WATCH_PARENT=1 mycontainer sh -c ") {
+		t.Errorf("unexpected docker args: %s", args)
+	}
+
+	// The control protocol works, given the same binary in the "container".
+	c = sh.FuncCmd(sendVarsFunc, map[string]string{"a": "1"})
+	c.Start()
+	eq(t, c.AwaitVars("a")["a"], "1")
+}
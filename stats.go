@@ -0,0 +1,47 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"time"
+)
+
+// ShellStats is a snapshot of a Shell's activity, as returned by Shell.Stats.
+// Commands run internally by gosh, e.g. "go build", are included.
+type ShellStats struct {
+	// CmdsStarted is the number of commands that were successfully started.
+	CmdsStarted int
+	// CmdsSucceeded and CmdsFailed are the numbers of started commands that
+	// have exited, with and without success respectively. A command fails if it
+	// exits with a non-zero code or is terminated by a signal.
+	CmdsSucceeded int
+	CmdsFailed    int
+	// CmdsRunning is the number of started commands that have not yet exited.
+	CmdsRunning int
+	// Builds is the number of binaries compiled by BuildGoPkg and related
+	// functions. Binaries that already existed are not counted.
+	Builds int
+	// BuildTime is the total time taken by the builds counted in Builds,
+	// including any time spent waiting per Shell.MaxConcurrentBuilds.
+	BuildTime time.Duration
+}
+
+// Stats returns a snapshot of this Shell's activity. Unlike most Shell methods,
+// it may be called concurrently with other methods, e.g. to report status
+// periodically. It never blocks on running commands.
+func (sh *Shell) Stats() ShellStats {
+	sh.statsMu.Lock()
+	defer sh.statsMu.Unlock()
+	res := sh.stats
+	res.CmdsRunning = res.CmdsStarted - res.CmdsSucceeded - res.CmdsFailed
+	return res
+}
+
+// updateStats calls f with the Shell's stats, under statsMu.
+func (sh *Shell) updateStats(f func(s *ShellStats)) {
+	sh.statsMu.Lock()
+	defer sh.statsMu.Unlock()
+	f(&sh.stats)
+}